@@ -69,7 +69,7 @@ func (we *wasmEngine) Run(ctx context.Context, name string, stdin io.Reader, env
 	log.Printf("module instantiated in %v", time.Since(ts))
 	if err != nil {
 		var exitErr *sys.ExitError
-		if errors.As(err, &exitErr); exitErr.ExitCode() != 0 {
+		if errors.As(err, &exitErr) && exitErr.ExitCode() != 0 {
 			return "", "", err
 		} else {
 			return "", "", fmt.Errorf("instantiation error: %w", err)
@@ -72,7 +72,7 @@ func newWasmEngine(ctx context.Context, wasmObj []byte) (*wasmEngine, error) {
 		rt.Close(ctx) // don't leak
 
 		var exitErr *sys.ExitError
-		if errors.As(err, &exitErr); exitErr.ExitCode() != 0 {
+		if errors.As(err, &exitErr) && exitErr.ExitCode() != 0 {
 			return nil, err
 		} else {
 			return nil, fmt.Errorf("instantiation error: %w", err)
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	adminModulesPrefix    = "/admin/modules/"
+	adminDefaultMaxUpload = 64 << 20 // 64 MiB
+
+	adminMaxCapabilitiesBody = 64 << 10 // 64 KiB
+)
+
+// adminHandler serves the runtime deployment API:
+//
+//	PUT  /admin/modules/{name}               deploy a new binary for the module
+//	POST /admin/modules/{name}/rollback      restore the previous deployment
+//	GET  /admin/modules/{name}/capabilities  show the capabilities granted
+//	PUT  /admin/modules/{name}/capabilities  replace the capabilities granted
+type adminHandler struct {
+	registry  *moduleRegistry
+	maxUpload int64
+}
+
+// checkAdminAddr refuses the addresses reachable from other hosts: the
+// admin API has no authentication, anyone reaching it can deploy code.
+// An empty host listens on every interface, and names other than
+// localhost may resolve to anything.
+func checkAdminAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%q is not a loopback address: the admin API has no authentication", addr)
+	}
+	return nil
+}
+
+type deploymentStatus struct {
+	Module     string    `json:"module"`
+	Revision   int       `json:"revision"`
+	Digest     string    `json:"digest"`
+	DeployedAt time.Time `json:"deployedAt"`
+}
+
+type capabilitiesStatus struct {
+	Module       string   `json:"module"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (ah *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, adminModulesPrefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	name, action, _ := strings.Cut(rest, "/")
+	slot, ok := ah.registry.Slot(name)
+	if !ok {
+		http.Error(w, "unknown module", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ah.deploy(w, r, slot)
+	case "rollback":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ah.rollback(w, r, slot)
+	case "capabilities":
+		switch r.Method {
+		case http.MethodGet:
+			writeCapabilities(w, slot)
+		case http.MethodPut:
+			ah.setCapabilities(w, r, slot)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ah *adminHandler) deploy(w http.ResponseWriter, r *http.Request, slot *moduleSlot) {
+	wasmObj, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ah.maxUpload))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "module too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("admin: deploying %d bytes for module %q", len(wasmObj), slot.name)
+	// the deployment must survive the upload request
+	dep, err := slot.Deploy(context.Background(), wasmObj)
+	if err != nil {
+		log.Printf("admin: module %q rejected: %v", slot.name, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeDeploymentStatus(w, slot.name, dep)
+}
+
+func (ah *adminHandler) rollback(w http.ResponseWriter, r *http.Request, slot *moduleSlot) {
+	dep, err := slot.Rollback(context.Background())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeDeploymentStatus(w, slot.name, dep)
+}
+
+func (ah *adminHandler) setCapabilities(w http.ResponseWriter, r *http.Request, slot *moduleSlot) {
+	var capabilities []string
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxCapabilitiesBody))
+	if err := dec.Decode(&capabilities); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if capabilities == nil {
+		capabilities = []string{} // explicit null means revoke all
+	}
+	if err := slot.opts.grants.Set(capabilities); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeCapabilities(w, slot)
+}
+
+func writeCapabilities(w http.ResponseWriter, slot *moduleSlot) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilitiesStatus{
+		Module:       slot.name,
+		Capabilities: slot.opts.grants.Capabilities(),
+	})
+}
+
+func writeDeploymentStatus(w http.ResponseWriter, name string, dep *deployment) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deploymentStatus{
+		Module:     name,
+		Revision:   dep.revision,
+		Digest:     dep.digest,
+		DeployedAt: dep.deployedAt,
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// echoRevision returns a distinct binary of the echo guest for each
+// revision, so each deployment gets its own digest.
+func echoRevision(revision int) []byte {
+	tm := echoModule()
+	tm.custom("test.revision", []byte(strconv.Itoa(revision)))
+	return tm.bytes()
+}
+
+func newTestAdmin(t *testing.T, wasmObj []byte) (*httptest.Server, *moduleSlot) {
+	t.Helper()
+	ctx := context.Background()
+	registry := newModuleRegistry(nil)
+	slot, err := registry.Register(ctx, "echo", wasmObj, moduleSettings{Capabilities: echoCapabilities})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Close(ctx) })
+	srv := httptest.NewServer(&adminHandler{registry: registry, maxUpload: 1 << 20})
+	t.Cleanup(srv.Close)
+	return srv, slot
+}
+
+func adminRequest(t *testing.T, method, url string, body []byte) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+func decodeDeploymentStatus(t *testing.T, data []byte) deploymentStatus {
+	t.Helper()
+	var status deploymentStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	return status
+}
+
+func TestAdminDeployAndRollback(t *testing.T) {
+	srv, slot := newTestAdmin(t, echoRevision(1))
+	url := srv.URL + adminModulesPrefix + "echo"
+
+	v2 := echoRevision(2)
+	code, body := adminRequest(t, http.MethodPut, url, v2)
+	if code != http.StatusOK {
+		t.Fatalf("deploy: got status %d: %s", code, body)
+	}
+	status := decodeDeploymentStatus(t, body)
+	if status.Module != "echo" || status.Revision != 2 || status.Digest != digestOf(v2) {
+		t.Fatalf("deploy: got %+v", status)
+	}
+	if got := slot.current.Load().digest; got != digestOf(v2) {
+		t.Fatalf("deploy: current is %s, want %s", got, digestOf(v2))
+	}
+
+	// a bad binary leaves the current deployment alone
+	code, body = adminRequest(t, http.MethodPut, url, []byte("not wasm"))
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("bad deploy: got status %d: %s", code, body)
+	}
+	if got := slot.current.Load().digest; got != digestOf(v2) {
+		t.Fatalf("bad deploy: current is %s, want %s", got, digestOf(v2))
+	}
+
+	code, body = adminRequest(t, http.MethodPost, url+"/rollback", nil)
+	if code != http.StatusOK {
+		t.Fatalf("rollback: got status %d: %s", code, body)
+	}
+	if status := decodeDeploymentStatus(t, body); status.Revision != 1 {
+		t.Fatalf("rollback: got %+v, want revision 1", status)
+	}
+	code, body = adminRequest(t, http.MethodPost, url+"/rollback", nil)
+	if code != http.StatusConflict {
+		t.Fatalf("second rollback: got status %d: %s", code, body)
+	}
+}
+
+func TestAdminRejectsBadRequests(t *testing.T) {
+	srv, _ := newTestAdmin(t, echoRevision(1))
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     []byte
+		wantCode int
+	}{
+		{name: "unknown module", method: http.MethodPut, path: "greet", wantCode: http.StatusNotFound},
+		{name: "unknown action", method: http.MethodPost, path: "echo/restart", wantCode: http.StatusNotFound},
+		{name: "deploy method", method: http.MethodPost, path: "echo", wantCode: http.StatusMethodNotAllowed},
+		{name: "rollback method", method: http.MethodGet, path: "echo/rollback", wantCode: http.StatusMethodNotAllowed},
+		{name: "too large", method: http.MethodPut, path: "echo", body: make([]byte, 2<<20), wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := adminRequest(t, tt.method, srv.URL+adminModulesPrefix+tt.path, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", code, tt.wantCode, body)
+			}
+		})
+	}
+}
+
+func TestAdminCapabilities(t *testing.T) {
+	srv, slot := newTestAdmin(t, echoRevision(1))
+	url := srv.URL + adminModulesPrefix + "echo/capabilities"
+	deploy := func(revision int) int {
+		code, body := adminRequest(t, http.MethodPut, srv.URL+adminModulesPrefix+"echo", echoRevision(revision))
+		if code != http.StatusOK && code != http.StatusUnprocessableEntity {
+			t.Fatalf("deploy revision %d: got status %d: %s", revision, code, body)
+		}
+		return code
+	}
+
+	code, body := adminRequest(t, http.MethodPut, url, []byte(`["nope"]`))
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("unknown capability: got status %d: %s", code, body)
+	}
+
+	// the guest imports are checked again on every deployment
+	for _, tt := range []struct {
+		capabilities string
+		wantCode     int
+	}{
+		{capabilities: `["io"]`, wantCode: http.StatusUnprocessableEntity},
+		{capabilities: `null`, wantCode: http.StatusUnprocessableEntity}, // the defaults
+		{capabilities: `["io", "body"]`, wantCode: http.StatusOK},
+	} {
+		code, body := adminRequest(t, http.MethodPut, url, []byte(tt.capabilities))
+		if code != http.StatusOK {
+			t.Fatalf("grant %s: got status %d: %s", tt.capabilities, code, body)
+		}
+		revision := slot.current.Load().revision
+		if code := deploy(revision + 1); code != tt.wantCode {
+			t.Fatalf("grant %s: got deploy status %d, want %d", tt.capabilities, code, tt.wantCode)
+		}
+		want := revision
+		if tt.wantCode == http.StatusOK {
+			want++
+		}
+		if got := slot.current.Load().revision; got != want {
+			t.Fatalf("grant %s: current is revision %d, want %d", tt.capabilities, got, want)
+		}
+	}
+}
+
+func TestSlotDrainsDeployments(t *testing.T) {
+	ctx := context.Background()
+	_, slot := newTestAdmin(t, echoRevision(1))
+
+	dep1 := slot.Acquire()
+	if _, err := slot.Deploy(ctx, echoRevision(2)); err != nil {
+		t.Fatal(err)
+	}
+	dep2 := slot.Acquire()
+	// drops revision 2, then revision 1
+	if _, err := slot.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	slot.Close(ctx)
+
+	// the slot dropped them, but they are still serving a request
+	for _, held := range []*deployment{dep2, dep1} {
+		var out bytes.Buffer
+		if err := held.engine.Run(ctx, "echo", strings.NewReader("hello"), testRequestEnv, &out); err != nil {
+			t.Fatalf("revision %d: %v", held.revision, err)
+		}
+		slot.Release(ctx, held)
+		err := held.engine.Run(ctx, "echo", strings.NewReader("hello"), testRequestEnv, io.Discard)
+		if !errors.Is(err, errEngineClosed) {
+			t.Fatalf("revision %d released: got error %v, want %v", held.revision, err, errEngineClosed)
+		}
+	}
+	if slot.Acquire() != nil {
+		t.Fatal("closed slot returned a deployment")
+	}
+}
+
+func TestCheckAdminAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "127.0.0.1:8081"},
+		{addr: "127.1.2.3:8081"},
+		{addr: "[::1]:8081"},
+		{addr: "localhost:8081"},
+		{addr: ":8081", wantErr: true},
+		{addr: "0.0.0.0:8081", wantErr: true},
+		{addr: "[::]:8081", wantErr: true},
+		{addr: "192.168.1.1:8081", wantErr: true},
+		{addr: "admin.example.com:8081", wantErr: true},
+		{addr: "127.0.0.1", wantErr: true}, // no port
+	}
+	for _, tt := range tests {
+		if err := checkAdminAddr(tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want one: %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+const (
+	bundleMaxEntrySize = 64 << 20  // 64 MiB
+	bundleMaxTotalSize = 256 << 20 // 256 MiB
+	bundleMaxEntries   = 1024
+)
+
+var (
+	errBundleUnsafePath = errors.New("unsafe path in bundle")
+	errBundleTooLarge   = errors.New("bundle entry too large")
+)
+
+// bundleFS is a read-only, in-memory view of a module bundle archive.
+// Only regular files are kept; the archive is fully validated on open,
+// so a bundle with any unsafe or oversize entry is rejected as a whole.
+type bundleFS struct {
+	files map[string][]byte
+	total int64
+}
+
+func openBundle(path string) (*bundleFS, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return openTarGzBundle(path)
+	case strings.HasSuffix(path, ".zip"):
+		return openZipBundle(path)
+	}
+	return nil, fmt.Errorf("unsupported bundle format: %q", path)
+}
+
+func openTarGzBundle(path string) (*bundleFS, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	bf := &bundleFS{files: make(map[string][]byte)}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA: // TypeRegA is written by old tar tools
+			// handled below
+		default:
+			// links can point anywhere: don't even try
+			return nil, fmt.Errorf("%w: %q: unsupported entry type %q", errBundleUnsafePath, hdr.Name, hdr.Typeflag)
+		}
+		if err := bf.add(hdr.Name, hdr.Size, tr); err != nil {
+			return nil, err
+		}
+	}
+	return bf, nil
+}
+
+func openZipBundle(path string) (*bundleFS, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	bf := &bundleFS{files: make(map[string][]byte)}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			return nil, fmt.Errorf("%w: %q: unsupported entry mode %v", errBundleUnsafePath, zf.Name, zf.Mode())
+		}
+		if zf.UncompressedSize64 > bundleMaxEntrySize {
+			return nil, fmt.Errorf("%w: %q: %d bytes", errBundleTooLarge, zf.Name, zf.UncompressedSize64)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = bf.add(zf.Name, int64(zf.UncompressedSize64), rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bf, nil
+}
+
+// add reads one entry. The declared size is checked upfront, but we never
+// trust it: the read is capped anyway.
+func (bf *bundleFS) add(name string, size int64, r io.Reader) error {
+	cleanName, err := bundleEntryName(name)
+	if err != nil {
+		return err
+	}
+	if len(bf.files) >= bundleMaxEntries {
+		return fmt.Errorf("%w: more than %d entries", errBundleTooLarge, bundleMaxEntries)
+	}
+	if _, ok := bf.files[cleanName]; ok {
+		return fmt.Errorf("duplicate bundle entry %q", cleanName)
+	}
+	if size > bundleMaxEntrySize {
+		return fmt.Errorf("%w: %q: %d bytes", errBundleTooLarge, cleanName, size)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, bundleMaxEntrySize+1))
+	if err != nil {
+		return fmt.Errorf("reading bundle entry %q: %w", cleanName, err)
+	}
+	if len(data) > bundleMaxEntrySize {
+		return fmt.Errorf("%w: %q: more than %d bytes", errBundleTooLarge, cleanName, bundleMaxEntrySize)
+	}
+	bf.total += int64(len(data))
+	if bf.total > bundleMaxTotalSize {
+		return fmt.Errorf("%w: more than %d bytes in total", errBundleTooLarge, bundleMaxTotalSize)
+	}
+
+	bf.files[cleanName] = data
+	return nil
+}
+
+func bundleEntryName(name string) (string, error) {
+	cleanName := strings.TrimPrefix(name, "./")
+	if strings.Contains(cleanName, `\`) || !fs.ValidPath(cleanName) || cleanName == "." {
+		return "", fmt.Errorf("%w: %q", errBundleUnsafePath, name)
+	}
+	return cleanName, nil
+}
+
+func (bf *bundleFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	data, ok := bf.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{
+		Reader: bytes.NewReader(data),
+		name:   name,
+		size:   int64(len(data)),
+	}, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testBundleEntry struct {
+	name     string
+	typeflag byte
+	content  string
+}
+
+func writeTarGzBundle(t *testing.T, entries ...testBundleEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     0o644,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag != tar.TypeReg && entry.typeflag != tar.TypeRegA {
+			hdr.Size = 0
+			hdr.Linkname = "/etc/passwd"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeZipBundle(t *testing.T, entries ...testBundleEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenBundle(t *testing.T) {
+	entries := []testBundleEntry{
+		{name: "manifest.json", typeflag: tar.TypeReg, content: "{}"},
+		{name: "./modules/echo.wasm", typeflag: tar.TypeReg, content: "echo"},
+		// written by old tar tools
+		{name: "modules/old.wasm", typeflag: tar.TypeRegA, content: "old"},
+	}
+	for format, path := range map[string]string{
+		"tar.gz": writeTarGzBundle(t, entries...),
+		"zip":    writeZipBundle(t, entries...),
+	} {
+		t.Run(format, func(t *testing.T) {
+			bf, err := openBundle(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string]string{
+				"manifest.json":     "{}",
+				"modules/echo.wasm": "echo",
+				"modules/old.wasm":  "old",
+			} {
+				got, err := fs.ReadFile(bf, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+			}
+			if _, err := bf.Open("modules/missing.wasm"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestOpenBundleRejectsUnsafePaths(t *testing.T) {
+	for _, name := range []string{
+		"../escape.wasm",
+		"modules/../../escape.wasm",
+		"/etc/escape.wasm",
+		`modules\..\escape.wasm`,
+		"modules//echo.wasm",
+		".",
+	} {
+		t.Run(name, func(t *testing.T) {
+			entry := testBundleEntry{name: name, typeflag: tar.TypeReg, content: "x"}
+			for _, path := range []string{writeTarGzBundle(t, entry), writeZipBundle(t, entry)} {
+				if _, err := openBundle(path); !errors.Is(err, errBundleUnsafePath) {
+					t.Errorf("%s: got error %v, want %v", filepath.Base(path), err, errBundleUnsafePath)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenBundleRejectsLinks(t *testing.T) {
+	for _, typeflag := range []byte{tar.TypeSymlink, tar.TypeLink} {
+		path := writeTarGzBundle(t, testBundleEntry{name: "modules/echo.wasm", typeflag: typeflag})
+		if _, err := openBundle(path); !errors.Is(err, errBundleUnsafePath) {
+			t.Errorf("type %q: got error %v, want %v", typeflag, err, errBundleUnsafePath)
+		}
+	}
+}
+
+func TestOpenBundleRejectsDuplicates(t *testing.T) {
+	path := writeTarGzBundle(t,
+		testBundleEntry{name: "modules/echo.wasm", typeflag: tar.TypeReg, content: "a"},
+		testBundleEntry{name: "./modules/echo.wasm", typeflag: tar.TypeReg, content: "b"},
+	)
+	if _, err := openBundle(path); err == nil {
+		t.Fatal("open succeeded, want an error")
+	}
+}
+
+func TestBundleAddCapsSizes(t *testing.T) {
+	bf := &bundleFS{files: make(map[string][]byte)}
+	// the declared size lies: the read must be capped anyway
+	big := bytes.NewReader(make([]byte, bundleMaxEntrySize+1))
+	if err := bf.add("big.wasm", 1, big); !errors.Is(err, errBundleTooLarge) {
+		t.Fatalf("got error %v, want %v", err, errBundleTooLarge)
+	}
+	if err := bf.add("big.wasm", bundleMaxEntrySize+1, bytes.NewReader(nil)); !errors.Is(err, errBundleTooLarge) {
+		t.Fatalf("declared size: got error %v, want %v", err, errBundleTooLarge)
+	}
+}
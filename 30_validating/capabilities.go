@@ -0,0 +1,133 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	hostModuleName = "httpwasm"
+)
+
+// hostFunctionGroups maps the capability groups to the host functions
+// they grant. A capability is either a group name or a function name.
+// Host functions exposing more data to the guests go in a group of
+// their own, so granting "io" never grants them by accident.
+var hostFunctionGroups = map[string][]string{
+	"io":     {"igets", "oputs", "eputs"},
+	"body":   {"igetbody", "ireadbody"},
+	"env":    {"igetenv", "ireadenv"},
+	"config": {"ireadconfig"},
+	"json":   {"ijsonget"},
+}
+
+// defaultCapabilities is what modules get if their settings don't say.
+// New groups must never be added here: they need to be explicitly granted.
+var defaultCapabilities = []string{"io"}
+
+var capabilityDenials = expvar.NewMap("capability_denials")
+
+// capabilityGrants tracks which host functions a module may call.
+// Grants are checked when a module is loaded, and on every call, so they
+// can be changed, and notably revoked, at runtime.
+type capabilityGrants struct {
+	module  string
+	granted atomic.Pointer[grantSet]
+}
+
+type grantSet struct {
+	capabilities []string
+	functions    map[string]bool
+}
+
+func newCapabilityGrants(module string, capabilities []string) (*capabilityGrants, error) {
+	cg := &capabilityGrants{
+		module: module,
+	}
+	if capabilities == nil {
+		capabilities = defaultCapabilities
+	}
+	if err := cg.Set(capabilities); err != nil {
+		return nil, err
+	}
+	return cg, nil
+}
+
+// Set replaces all the grants at once.
+func (cg *capabilityGrants) Set(capabilities []string) error {
+	gs := grantSet{
+		capabilities: slices.Clone(capabilities),
+		functions:    make(map[string]bool),
+	}
+	for _, capName := range capabilities {
+		fns, err := expandCapability(capName)
+		if err != nil {
+			return err
+		}
+		for _, fn := range fns {
+			gs.functions[fn] = true
+		}
+	}
+	sort.Strings(gs.capabilities)
+	cg.granted.Store(&gs)
+	log.Printf("module %q: granted capabilities %v", cg.module, gs.capabilities)
+	return nil
+}
+
+func (cg *capabilityGrants) Capabilities() []string {
+	return slices.Clone(cg.granted.Load().capabilities)
+}
+
+func (cg *capabilityGrants) Allowed(fn string) bool {
+	return cg.granted.Load().functions[fn]
+}
+
+// Missing returns the capabilities, among the given ones, not fully granted.
+func (cg *capabilityGrants) Missing(capabilities []string) []string {
+	var missing []string
+	for _, capName := range capabilities {
+		fns, err := expandCapability(capName)
+		if err != nil {
+			missing = append(missing, capName)
+			continue
+		}
+		for _, fn := range fns {
+			if !cg.Allowed(fn) {
+				missing = append(missing, capName)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// Enforce is meant to be called by host functions on entry. A denied call
+// traps the guest: there is no sensible value to return instead.
+func (cg *capabilityGrants) Enforce(fn string) {
+	if cg.Allowed(fn) {
+		return
+	}
+	cg.recordDenial("call to", fn)
+	panic(fmt.Errorf("%w: call to %s.%s denied: capability not granted", errHostFunction, hostModuleName, fn))
+}
+
+func (cg *capabilityGrants) recordDenial(what, fn string) {
+	capabilityDenials.Add(cg.module+"."+fn, 1)
+	log.Printf("module %q: denied %s %s.%s: capability not granted", cg.module, what, hostModuleName, fn)
+}
+
+func expandCapability(capName string) ([]string, error) {
+	if fns, ok := hostFunctionGroups[capName]; ok {
+		return fns, nil
+	}
+	for _, fns := range hostFunctionGroups {
+		if slices.Contains(fns, capName) {
+			return []string{capName}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown capability %q", capName)
+}
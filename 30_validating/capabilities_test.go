@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// importingModule builds a guest importing the host function, and doing
+// nothing with it.
+func importingModule(fn string, params, results []api.ValueType) []byte {
+	var tm testModule
+	tm.importFunc(hostModuleName, fn, params, results)
+	tm.memoryPages(1)
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+	stubAllocator(&tm)
+	return tm.bytes()
+}
+
+func TestEngineLinksGrantedFunctionsOnly(t *testing.T) {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	tests := []struct {
+		fn      string
+		group   string
+		params  []api.ValueType
+		results []api.ValueType
+	}{
+		{fn: "igetbody", group: "body", results: []api.ValueType{i64}},
+		{fn: "ireadbody", group: "body", params: []api.ValueType{i32, i32}, results: []api.ValueType{i32}},
+		{fn: "igetenv", group: "env", results: []api.ValueType{i64}},
+		{fn: "ireadenv", group: "env", params: []api.ValueType{i32, i32}, results: []api.ValueType{i32}},
+		{fn: "ireadconfig", group: "config", params: []api.ValueType{i32, i32}, results: []api.ValueType{i32}},
+		{fn: "ijsonget", group: "json", params: []api.ValueType{i32, i32, i32, i32}, results: []api.ValueType{i64}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fn, func(t *testing.T) {
+			if slices.Contains(defaultCapabilities, tt.group) {
+				t.Fatalf("group %q is granted by default", tt.group)
+			}
+			wasmObj := importingModule(tt.fn, tt.params, tt.results)
+			for _, capabilities := range [][]string{nil, {"io"}, otherGroups(tt.group)} {
+				grants, err := newCapabilityGrants("test", capabilities)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = newWasmEngine(context.Background(), wasmObj, engineOptions{name: "test", grants: grants})
+				if err == nil || !strings.Contains(err.Error(), tt.fn+": capability not granted") {
+					t.Fatalf("capabilities %v: got error %v, want a link failure", capabilities, err)
+				}
+			}
+			// the function name grants it alone
+			for _, capabilities := range [][]string{{tt.group}, {tt.fn}} {
+				newTestEngine(t, wasmObj, moduleSettings{Capabilities: capabilities})
+			}
+		})
+	}
+}
+
+// otherGroups returns all the groups but the given one.
+func otherGroups(group string) []string {
+	var groups []string
+	for name := range hostFunctionGroups {
+		if name != group {
+			groups = append(groups, name)
+		}
+	}
+	return groups
+}
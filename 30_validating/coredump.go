@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+const (
+	coredumpExt              = ".coredump"
+	coredumpDefaultRetention = 10
+	coredumpExecutableName   = "httpwasm"
+	coredumpThreadName       = "main"
+
+	wasmSectionMemory = 5
+	wasmSectionData   = 11
+
+	wasmPageSize = 65536
+
+	wasmValueTypeV128    = 0x7b
+	wasmValueTypeFuncref = 0x70
+)
+
+// coredumpWriter stores guest core dumps, keeping only the most recent.
+// The dumps hold the guest memory, and so the request data: only the
+// host user can read them.
+type coredumpWriter struct {
+	dir       string
+	retention int
+
+	mu sync.Mutex // serializes writes and pruning
+}
+
+func newCoredumpWriter(dir string, retention int) (*coredumpWriter, error) {
+	if retention <= 0 {
+		return nil, fmt.Errorf("coredump retention must be positive, got %d", retention)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	// MkdirAll leaves existing directories alone
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &coredumpWriter{
+		dir:       dir,
+		retention: retention,
+	}, nil
+}
+
+// coredumpFileName names the dump after the request and the module binary.
+// The request ID may come from the client: the random suffix keeps it from
+// choosing the name, or overwriting earlier dumps by reusing the ID.
+func coredumpFileName(requestID, digest string) string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return requestID + "-" + strings.ReplaceAll(digest, ":", "-") + "-" + hex.EncodeToString(suffix[:]) + coredumpExt
+}
+
+func (cw *coredumpWriter) Write(requestID, digest string, data []byte) (string, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	path := filepath.Join(cw.dir, coredumpFileName(requestID, digest))
+	if err := writeCoredumpFile(path, data); err != nil {
+		return "", err
+	}
+	cw.prune()
+	return path, nil
+}
+
+// writeCoredumpFile never follows nor replaces an existing file: the
+// names are unique anyway.
+func writeCoredumpFile(path string, data []byte) error {
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(data)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path) // don't leave a truncated dump behind
+	}
+	return err
+}
+
+// prune removes the oldest dumps past the retention limit.
+func (cw *coredumpWriter) prune() {
+	paths, err := filepath.Glob(filepath.Join(cw.dir, "*"+coredumpExt))
+	if err != nil || len(paths) <= cw.retention {
+		return
+	}
+	type dumpFile struct {
+		path    string
+		modTime int64
+	}
+	var dumps []dumpFile
+	for _, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		dumps = append(dumps, dumpFile{path: path, modTime: st.ModTime().UnixNano()})
+	}
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].modTime > dumps[j].modTime
+	})
+	for i := cw.retention; i < len(dumps); i++ {
+		if err := os.Remove(dumps[i].path); err != nil {
+			log.Printf("coredump: cannot remove %q: %v", dumps[i].path, err)
+		}
+	}
+}
+
+// coreFrame is a guest stack frame, as far as the core dump is concerned.
+type coreFrame struct {
+	funcIdx uint32
+	// relative to the start of the function body, zero if unknown
+	codeOffset uint32
+}
+
+// coreFrames maps the guest frames of the stack trace wazero attached
+// to err, innermost first. Host frames are skipped. The code offsets
+// are only known if wazero could resolve them, which requires DWARF,
+// and if the code is the original one, see bodyOffsets.
+func (ms *moduleSymbols) coreFrames(err error) []coreFrame {
+	var frames []coreFrame
+	for _, entry := range parseWazeroTrace(err) {
+		fn, ok := ms.guestFunction(entry.desc)
+		if !ok {
+			continue
+		}
+		idx, ok := ms.funcIndex[fn]
+		if !ok {
+			n, err := strconv.ParseUint(strings.TrimPrefix(fn, unknownFunctionPrefix), 10, 32)
+			if err != nil {
+				continue
+			}
+			idx = uint32(n)
+		}
+		cf := coreFrame{funcIdx: idx}
+		if len(entry.sources) > 0 && idx >= ms.importedFuncs && int(idx-ms.importedFuncs) < len(ms.bodyOffsets) {
+			addr, _, _ := strings.Cut(entry.sources[0], ":")
+			start := ms.bodyOffsets[idx-ms.importedFuncs]
+			if off, err := strconv.ParseUint(strings.TrimPrefix(addr, "0x"), 16, 32); err == nil && uint32(off) >= start {
+				cf.codeOffset = uint32(off) - start
+			}
+		}
+		frames = append(frames, cf)
+	}
+	return frames
+}
+
+// buildCoredump serializes the guest state following the WebAssembly
+// tool-conventions core dump format: a wasm module whose memory and
+// globals hold the guest state, with the process, instance and stack
+// information in custom sections.
+// Locals and operand stack values are not available from wazero, so
+// the frames have none.
+func buildCoredump(modName string, mod api.Module, frames []coreFrame) []byte {
+	var out bytes.Buffer
+	out.Write(wasmHeader)
+
+	var core []byte
+	core = append(core, 0x00) // process-info
+	core = appendName(core, coredumpExecutableName)
+	writeCustomSection(&out, "core", core)
+
+	var modules []byte
+	modules = binary.AppendUvarint(modules, 1)
+	modules = append(modules, 0x00)
+	modules = appendName(modules, modName)
+	writeCustomSection(&out, "coremodules", modules)
+
+	var globals []byte
+	numGlobals := 0
+	if im, ok := mod.(experimental.InternalModule); ok {
+		numGlobals = im.NumGlobal()
+		globals = binary.AppendUvarint(globals, uint64(numGlobals))
+		for i := 0; i < numGlobals; i++ {
+			globals = appendGlobal(globals, im.Global(i))
+		}
+	}
+
+	var instances []byte
+	instances = binary.AppendUvarint(instances, 1)
+	instances = append(instances, 0x00)
+	instances = binary.AppendUvarint(instances, 0) // module index
+	if guestMemory(mod) != nil {
+		instances = binary.AppendUvarint(instances, 1)
+		instances = binary.AppendUvarint(instances, 0)
+	} else {
+		instances = binary.AppendUvarint(instances, 0)
+	}
+	instances = binary.AppendUvarint(instances, uint64(numGlobals))
+	for i := 0; i < numGlobals; i++ {
+		instances = binary.AppendUvarint(instances, uint64(i))
+	}
+	writeCustomSection(&out, "coreinstances", instances)
+
+	var stack []byte
+	stack = append(stack, 0x00) // thread-info
+	stack = appendName(stack, coredumpThreadName)
+	stack = binary.AppendUvarint(stack, uint64(len(frames)))
+	for _, cf := range frames {
+		stack = append(stack, 0x00)
+		stack = binary.AppendUvarint(stack, 0) // instance index
+		stack = binary.AppendUvarint(stack, uint64(cf.funcIdx))
+		stack = binary.AppendUvarint(stack, uint64(cf.codeOffset))
+		stack = binary.AppendUvarint(stack, 0) // locals
+		stack = binary.AppendUvarint(stack, 0) // operand stack
+	}
+	writeCustomSection(&out, "corestack", stack)
+
+	// the sections must be in order: memory, global, data
+	var data []byte
+	if mem := guestMemory(mod); mem != nil {
+		data, _ = mem.Read(0, mem.Size())
+
+		var memories []byte
+		memories = binary.AppendUvarint(memories, 1)
+		memories = append(memories, 0x00) // min only
+		memories = binary.AppendUvarint(memories, uint64(len(data)/wasmPageSize))
+		writeSection(&out, wasmSectionMemory, memories)
+	}
+	if globals != nil {
+		writeSection(&out, wasmSectionGlobal, globals)
+	}
+	if data != nil {
+		writeSection(&out, wasmSectionData, appendMemorySegments(nil, data))
+	}
+	return out.Bytes()
+}
+
+// appendMemorySegments encodes the memory as active data segments,
+// skipping the pages which are all zeroes, like most of a fresh heap.
+func appendMemorySegments(out []byte, data []byte) []byte {
+	type segment struct {
+		start, end int
+	}
+	var segments []segment
+	for start := 0; start < len(data); start += wasmPageSize {
+		end := min(start+wasmPageSize, len(data))
+		if isZero(data[start:end]) {
+			continue
+		}
+		if n := len(segments); n > 0 && segments[n-1].end == start {
+			segments[n-1].end = end
+			continue
+		}
+		segments = append(segments, segment{start: start, end: end})
+	}
+
+	out = binary.AppendUvarint(out, uint64(len(segments)))
+	for _, seg := range segments {
+		out = append(out, 0x00, 0x41) // active, memory 0, i32.const
+		out = appendSleb(out, int64(int32(seg.start)))
+		out = append(out, 0x0b) // end
+		out = binary.AppendUvarint(out, uint64(seg.end-seg.start))
+		out = append(out, data[seg.start:seg.end]...)
+	}
+	return out
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// appendGlobal encodes the global with its current value as initializer.
+// wazero doesn't tell which globals are mutable, and the dump is never
+// executed anyway: all the globals are dumped as immutable.
+func appendGlobal(out []byte, g api.Global) []byte {
+	const mut = 0x00
+	out = append(out, g.Type(), mut)
+	return appendConstExpr(out, g.Type(), g.Get())
+}
+
+// appendConstExpr encodes the constant expression yielding the value.
+// References can't be meaningfully encoded, they become null; for v128
+// only the low 64 bits are available, as wazero returns them.
+func appendConstExpr(out []byte, valType api.ValueType, val uint64) []byte {
+	switch valType {
+	case api.ValueTypeI32:
+		out = append(out, 0x41)
+		out = appendSleb(out, int64(int32(val)))
+	case api.ValueTypeI64:
+		out = append(out, 0x42)
+		out = appendSleb(out, int64(val))
+	case api.ValueTypeF32:
+		out = append(out, 0x43)
+		out = binary.LittleEndian.AppendUint32(out, uint32(val))
+	case api.ValueTypeF64:
+		out = append(out, 0x44)
+		out = binary.LittleEndian.AppendUint64(out, val)
+	case api.ValueTypeExternref, wasmValueTypeFuncref:
+		out = append(out, 0xd0, valType) // ref.null
+	default:
+		out = append(out, 0xfd, 0x0c) // v128.const
+		out = binary.LittleEndian.AppendUint64(out, val)
+		out = binary.LittleEndian.AppendUint64(out, 0)
+	}
+	return append(out, 0x0b) // end
+}
+
+func writeSection(out *bytes.Buffer, id byte, payload []byte) {
+	out.WriteByte(id)
+	out.Write(binary.AppendUvarint(nil, uint64(len(payload))))
+	out.Write(payload)
+}
+
+func writeCustomSection(out *bytes.Buffer, name string, content []byte) {
+	writeSection(out, wasmSectionCustom, append(appendName(nil, name), content...))
+}
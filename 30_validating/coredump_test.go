@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// readCoreStack decodes the function indices and code offsets of the
+// frames in the corestack section of the dump.
+func readCoreStack(t *testing.T, dump []byte) []coreFrame {
+	t.Helper()
+	sections, err := parseWasmSections(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sec := range sections {
+		if sec.id != wasmSectionCustom || customSectionName(sec.payload) != "corestack" {
+			continue
+		}
+		rd := wasmReader{data: sec.payload}
+		u32 := func() uint32 {
+			v, err := rd.u32()
+			if err != nil {
+				t.Fatalf("malformed corestack: %v", err)
+			}
+			return v
+		}
+		rd.bytes() // the section name
+		rd.byte()  // thread-info
+		rd.bytes() // the thread name
+		var frames []coreFrame
+		for n := u32(); n > 0; n-- {
+			rd.byte() // frame
+			u32()     // instance index
+			cf := coreFrame{funcIdx: u32(), codeOffset: u32()}
+			u32() // locals
+			u32() // operand stack
+			frames = append(frames, cf)
+		}
+		return frames
+	}
+	t.Fatal("no corestack section")
+	return nil
+}
+
+func TestBuildCoredump(t *testing.T) {
+	ctx := context.Background()
+	var tm testModule
+	tm.memoryPages(3)
+	tm.dataAt(16, []byte("hello"))
+	tm.dataAt(2*wasmPageSize+8, []byte("world"))
+	counter := tm.global(api.ValueTypeI32, true, 0)
+	tm.global(api.ValueTypeI64, false, -5)
+	tm.exportGlobal("counter", counter)
+
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	mod, err := rt.Instantiate(ctx, tm.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod.ExportedGlobal("counter").(api.MutableGlobal).Set(42)
+	mod.Memory().WriteString(100, "state")
+
+	frames := []coreFrame{{funcIdx: 3, codeOffset: 12}, {funcIdx: 1}}
+	dump := buildCoredump("test", mod, frames)
+
+	if got := readCoreStack(t, dump); !slices.Equal(got, frames) {
+		t.Fatalf("got frames %v, want %v", got, frames)
+	}
+	// the zero page in the middle is skipped
+	if len(dump) > 2*wasmPageSize+1024 {
+		t.Fatalf("got a %d bytes dump", len(dump))
+	}
+
+	// the dump is a module whose state is the one dumped
+	core, err := rt.Instantiate(ctx, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := mod.Memory().Read(0, mod.Memory().Size())
+	got, _ := core.Memory().Read(0, core.Memory().Size())
+	if !bytes.Equal(got, want) {
+		t.Fatal("the dumped memory differs")
+	}
+	im := core.(experimental.InternalModule)
+	if im.NumGlobal() != 2 || im.Global(0).Get() != 42 || int64(im.Global(1).Get()) != -5 {
+		t.Fatalf("got globals %d and %d, want 42 and -5", im.Global(0).Get(), int64(im.Global(1).Get()))
+	}
+}
+
+func TestBuildCoredumpWithoutMemory(t *testing.T) {
+	ctx := context.Background()
+	var tm testModule
+	tm.global(api.ValueTypeI32, true, 7)
+
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	mod, err := rt.Instantiate(ctx, tm.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Instantiate(ctx, buildCoredump("test", mod, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineWritesCoredumps(t *testing.T) {
+	ctx := context.Background()
+	var tm testModule
+	tm.memoryPages(1)
+	tm.function(nil, nil, nil)
+	run := tm.function(nil, nil, nil, []byte{0x00}) // unreachable
+	tm.exportFunc(runFnName, run)
+
+	for _, fuel := range []int64{0, 1_000_000} {
+		dir := t.TempDir()
+		cw, err := newCoredumpWriter(dir, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		we := newTestEngine(t, tm.bytes(), moduleSettings{Fuel: fuel})
+		we.coredumps = cw
+
+		for range 2 {
+			if err := we.Run(withRequestID(ctx, "req-1"), "test", strings.NewReader(""), testRequestEnv, io.Discard); err == nil {
+				t.Fatal("run succeeded")
+			}
+		}
+		paths, err := filepath.Glob(filepath.Join(dir, "req-1-*"+coredumpExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 1 {
+			t.Fatalf("fuel %d: got dumps %v, want only the most recent", fuel, paths)
+		}
+		// the dumps hold the request data
+		for path, want := range map[string]os.FileMode{dir: 0o700, paths[0]: 0o600} {
+			st, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := st.Mode().Perm(); perm != want {
+				t.Fatalf("%s: got permissions %v, want %v", path, perm, want)
+			}
+		}
+		dump, err := os.ReadFile(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames := readCoreStack(t, dump)
+		if len(frames) != 1 || frames[0].funcIdx != run {
+			t.Fatalf("fuel %d: got frames %v, want one in function %d", fuel, frames, run)
+		}
+		// the instrumented code is not the one debuggers see
+		if fuel > 0 && frames[0].codeOffset != 0 {
+			t.Fatalf("fuel %d: got code offset %d", fuel, frames[0].codeOffset)
+		}
+	}
+}
+
+func TestCoredumpFileName(t *testing.T) {
+	digest := digestOf([]byte("module"))
+	first := coredumpFileName("req-1", digest)
+	second := coredumpFileName("req-1", digest)
+	if first == second {
+		t.Fatalf("the same request ID got the same name twice: %q", first)
+	}
+	for _, name := range []string{first, second} {
+		if !strings.HasPrefix(name, "req-1-sha256-") || !strings.HasSuffix(name, coredumpExt) || strings.Contains(name, ":") {
+			t.Fatalf("got name %q", name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+const (
+	// how much the deterministic clocks advance on each reading
+	deterministicClockStep = time.Millisecond
+)
+
+// deterministicSettings pins all the sources of nondeterminism WASI gives
+// to guests, so the same request always gets the same output.
+// Meant for tests and replay only.
+type deterministicSettings struct {
+	// Seed of the random source.
+	Seed int64 `json:"seed"`
+	// Walltime is the wall clock time when each request starts.
+	// Defaults to the unix epoch.
+	Walltime time.Time `json:"walltime,omitempty"`
+}
+
+// deterministicEnv provides the clocks and the random source for
+// a deterministic guest. Both clocks start from the pinned values
+// and advance by a fixed step on each reading, or by the requested
+// amount on sleep, without ever actually sleeping.
+// Everything is reset before each request.
+type deterministicEnv struct {
+	walltime time.Time
+	seed     int64
+
+	elapsed time.Duration
+	rng     *rand.Rand
+}
+
+func newDeterministicEnv(ds *deterministicSettings) *deterministicEnv {
+	walltime := ds.Walltime
+	if walltime.IsZero() {
+		walltime = time.Unix(0, 0)
+	}
+	de := &deterministicEnv{
+		walltime: walltime,
+		seed:     ds.Seed,
+	}
+	de.reset()
+	return de
+}
+
+func (de *deterministicEnv) reset() {
+	de.elapsed = 0
+	de.rng = rand.New(rand.NewSource(de.seed))
+}
+
+// apply overrides the clocks and random source of the config.
+func (de *deterministicEnv) apply(config wazero.ModuleConfig) wazero.ModuleConfig {
+	resolution := sys.ClockResolution(deterministicClockStep.Nanoseconds())
+	return config.
+		WithWalltime(de.readWalltime, resolution).
+		WithNanotime(de.readNanotime, resolution).
+		WithNanosleep(de.nanosleep).
+		WithOsyield(func() {}).
+		WithRandSource(de)
+}
+
+func (de *deterministicEnv) tick() time.Duration {
+	de.elapsed += deterministicClockStep
+	return de.elapsed
+}
+
+func (de *deterministicEnv) readWalltime() (int64, int32) {
+	now := de.walltime.Add(de.tick())
+	return now.Unix(), int32(now.Nanosecond())
+}
+
+func (de *deterministicEnv) readNanotime() int64 {
+	return de.tick().Nanoseconds()
+}
+
+func (de *deterministicEnv) nanosleep(ns int64) {
+	de.elapsed += time.Duration(ns)
+}
+
+func (de *deterministicEnv) Read(p []byte) (int, error) {
+	return de.rng.Read(p)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// entropyModule builds a guest writing out the wall clock, the monotonic
+// clock, then 32 random bytes.
+func entropyModule() []byte {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	var tm testModule
+	clockTimeGet := tm.importFunc("wasi_snapshot_preview1", "clock_time_get", []api.ValueType{i32, i64, i32}, []api.ValueType{i32})
+	randomGet := tm.importFunc("wasi_snapshot_preview1", "random_get", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	const drop = 0x1a
+	run := tm.function(nil, nil, nil,
+		opI32Const(0), opI64Const(1), opI32Const(0), opCall(clockTimeGet), []byte{drop}, // realtime
+		opI32Const(1), opI64Const(1), opI32Const(8), opCall(clockTimeGet), []byte{drop}, // monotonic
+		opI32Const(16), opI32Const(32), opCall(randomGet), []byte{drop},
+		opI32Const(0), opI32Const(48), opCall(puts),
+	)
+	tm.exportFunc(runFnName, run)
+	return tm.bytes()
+}
+
+func TestDeterministicRuns(t *testing.T) {
+	wasmObj := entropyModule()
+	settings := func(seed int64) moduleSettings {
+		return moduleSettings{Deterministic: &deterministicSettings{Seed: seed}}
+	}
+
+	first := newTestEngine(t, wasmObj, settings(42))
+	want := runOutput(t, first, "")
+	// everything is reset before each request
+	if got := runOutput(t, first, ""); !bytes.Equal(got, want) {
+		t.Fatalf("second request: got %x, want %x", got, want)
+	}
+	second := newTestEngine(t, wasmObj, settings(42))
+	if got := runOutput(t, second, ""); !bytes.Equal(got, want) {
+		t.Fatalf("second engine: got %x, want %x", got, want)
+	}
+
+	// the clocks start from the pinned values, and advance on each reading
+	walltime := time.Unix(0, int64(binary.LittleEndian.Uint64(want)))
+	if wantWalltime := time.Unix(0, 0).Add(deterministicClockStep); !walltime.Equal(wantWalltime) {
+		t.Fatalf("got wall clock %v, want %v", walltime, wantWalltime)
+	}
+	if nanotime := binary.LittleEndian.Uint64(want[8:]); nanotime != uint64(2*deterministicClockStep) {
+		t.Fatalf("got monotonic clock %d, want %d", nanotime, 2*deterministicClockStep)
+	}
+
+	other := newTestEngine(t, wasmObj, settings(43))
+	if got := runOutput(t, other, ""); bytes.Equal(got[16:], want[16:]) {
+		t.Fatal("got the same random bytes from another seed")
+	}
+	live := newTestEngine(t, wasmObj, moduleSettings{})
+	if got := runOutput(t, live, ""); bytes.Equal(got, want) {
+		t.Fatal("got the deterministic output without deterministic mode")
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/tetratelabs/wazero"
@@ -17,182 +20,656 @@ import (
 
 const (
 	runFnName = "run"
+
+	// the call data holding larger buffers is not recycled
+	callDataMaxRecycle = 1 << 20
+)
+
+var (
+	errEngineClosed  = errors.New("engine closed")
+	errResponseWrite = errors.New("cannot write the response")
+	errNoAllocator   = errors.New("the guest allocator can't be used during the initialization")
 )
 
 // xref: https://github.com/tetratelabs/wazero/issues/985
 type wasmEngine struct {
-	code     wazero.CompiledModule
-	rt       wazero.Runtime
-	hostMod  api.Module
-	guestMod api.Module
-	stack    []uint64
+	code    wazero.CompiledModule
+	rt      wazero.Runtime
+	hostMod api.Module
+	// to create new guest instances
+	config     wazero.ModuleConfig
+	name       string
+	entrypoint string
+
+	// the current guest instance; nil if recycling it failed
+	guestMod  api.Module
+	stack     []uint64
+	allocator bool // the guest uses allocating host functions
+	// nil unless allocator
 	mallocFn api.Function
 	freeFn   api.Function
 	runFn    api.Function
+	abi      hostABI
+	grants   *capabilityGrants
+	// nil unless running in deterministic mode
+	det *deterministicEnv
+	// nil unless fuel metering is enabled
+	fuel   api.MutableGlobal
+	budget int64
+	limits limitsSettings
+	// the module configuration, see ireadconfig
+	moduleConfig []byte
+	// instance health management
+	recycle    recycleSettings
+	requests   int
+	baseMemory uint32
+	// if enabled, the guest state is restored after each request
+	snapshots bool
+	globals   []string
+	snapshot  *memorySnapshot
+	// to symbolicate the stack traces of failed calls
+	symbols *moduleSymbols
+	// nil unless core dumps are enabled
+	coredumps *coredumpWriter
+	digest    string
+
+	// the call data of the requests, with their buffers
+	calls sync.Pool
+
+	// the guest instance is not reentrant, and Close must wait
+	// for the inflight Run, if any
+	mu     sync.Mutex
+	closed bool
 }
 
 func (we *wasmEngine) Close(ctx context.Context) error {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	if we.closed {
+		return nil
+	}
+	we.closed = true
 	// hostMod closed when we close the runtime
 	// guestMod closed when we close the runtime
 	return we.rt.Close(ctx)
 }
 
-func newWasmEngine(ctx context.Context, wasmObj []byte) (*wasmEngine, error) {
+// engineOptions carries everything an engine needs besides the module binary.
+type engineOptions struct {
+	name     string
+	settings moduleSettings
+	grants   *capabilityGrants
+	sandbox  *sandbox
+	problems *problemPolicy
+	// nil unless core dumps are enabled
+	coredumps *coredumpWriter
+}
+
+func newWasmEngine(ctx context.Context, wasmObj []byte, opts engineOptions) (*wasmEngine, error) {
 	var ts time.Time
 
+	limits, err := opts.settings.Limits.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.settings.Recycle.validate(); err != nil {
+		return nil, err
+	}
+
 	ts = time.Now()
-	rt := wazero.NewRuntime(ctx)
+	// we need the custom sections to read the guest metadata, and the
+	// guest to stop on the request deadline
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCustomSections(true).WithCloseOnContextDone(true))
 	log.Printf("wazero runtime created in %v", time.Since(ts))
 
-	ts = time.Now()
-	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
-	log.Printf("wasi registered in %v", time.Since(ts))
+	// fuel instrumentation changes the binary: we want the original
+	digest := digestOf(wasmObj)
 
 	ts = time.Now()
-	hostMod, err := rt.NewHostModuleBuilder("httpwasm").
-		NewFunctionBuilder().WithFunc(igets).Export("igets").
-		NewFunctionBuilder().WithFunc(eputs).Export("eputs").
-		NewFunctionBuilder().WithFunc(oputs).Export("oputs").
-		Instantiate(ctx)
-	log.Printf("host module instantiated in in %v", time.Since(ts))
+	symbols := readModuleSymbols(wasmObj)
+	log.Printf("module symbols read in %v", time.Since(ts))
+
+	if opts.settings.Fuel > 0 {
+		ts = time.Now()
+		wasmObj, err = instrumentFuel(wasmObj)
+		if err != nil {
+			rt.Close(ctx) // don't leak
+			return nil, fmt.Errorf("fuel instrumentation: %w", err)
+		}
+		// the offsets in the rewritten code mean nothing to debuggers,
+		// which load the original binary: the core dumps won't have any
+		symbols.bodyOffsets = nil
+		log.Printf("module instrumented for fuel metering in %v", time.Since(ts))
+	}
+
+	var snapshotGlobals []string
+	if opts.settings.Snapshot {
+		ts = time.Now()
+		wasmObj, snapshotGlobals, err = exportMutableGlobals(wasmObj)
+		if err != nil {
+			rt.Close(ctx) // don't leak
+			return nil, fmt.Errorf("snapshot instrumentation: %w", err)
+		}
+		log.Printf("module instrumented for snapshots in %v (%d mutable globals)", time.Since(ts), len(snapshotGlobals))
+	}
 
 	ts = time.Now()
 	code, err := rt.CompileModule(ctx, wasmObj)
 	if err != nil {
-		return nil, err
+		rt.Close(ctx) // don't leak
+		return nil, newGuestError(errKindCompile, err)
 	}
 	log.Printf("module compiled in %v", time.Since(ts))
 
+	meta, err := readGuestMeta(code)
+	if err != nil {
+		rt.Close(ctx) // don't leak
+		return nil, err
+	}
+	abi, err := negotiateABI(meta)
+	if err != nil {
+		rt.Close(ctx) // don't leak
+		return nil, err
+	}
+	if missing := opts.grants.Missing(meta.Capabilities); len(missing) > 0 {
+		rt.Close(ctx) // don't leak
+		return nil, fmt.Errorf("module requires capabilities not granted: %v", missing)
+	}
+	log.Printf("module uses ABI version %d, entrypoint %q (%s)", abi.version, meta.Entrypoint, meta.Description)
+
+	kind, err := detectModuleKind(code)
+	if err != nil {
+		rt.Close(ctx) // don't leak
+		return nil, newGuestError(errKindInstantiate, err)
+	}
+	log.Printf("module %q is a %s", opts.name, kind)
+
 	ts = time.Now()
-	config := wazero.NewModuleConfig().WithName("httpwasm_guest") // TODO
-	// also invokes the _start function
-	guestMod, err := rt.InstantiateModule(ctx, code, config)
-	log.Printf("module instantiated in %v (%v)", time.Since(ts), err)
+	wasiCode, err := wasi_snapshot_preview1.NewBuilder(rt).Compile(ctx)
 	if err != nil {
 		rt.Close(ctx) // don't leak
+		return nil, err
+	}
+	if _, err = rt.InstantiateModule(ctx, wasiCode, wazero.NewModuleConfig()); err != nil {
+		rt.Close(ctx) // don't leak
+		return nil, err
+	}
+	log.Printf("wasi registered in %v", time.Since(ts))
 
-		var exitErr *sys.ExitError
-		if errors.As(err, &exitErr); exitErr.ExitCode() != 0 {
-			return nil, err
-		} else {
-			return nil, fmt.Errorf("instantiation error: %w", err)
-		}
+	ts = time.Now()
+	hostCode, err := newHostModuleBuilder(rt, abi).Compile(ctx)
+	if err != nil {
+		rt.Close(ctx) // don't leak
+		return nil, err
+	}
+	hostMod, err := rt.InstantiateModule(ctx, hostCode, wazero.NewModuleConfig())
+	if err != nil {
+		rt.Close(ctx) // don't leak
+		return nil, err
 	}
+	log.Printf("host module version %d instantiated in in %v", abi.version, time.Since(ts))
 
 	ts = time.Now()
-	mallocFn := guestMod.ExportedFunction("malloc")
-	if mallocFn == nil {
+	err = preflightCheck(code, meta.Entrypoint, opts.grants, wasiCode, hostCode)
+	log.Printf("module preflight checked in %v (%v)", time.Since(ts), err)
+	if err != nil {
 		rt.Close(ctx) // don't leak
-		return nil, fmt.Errorf("failed to lookup function %q", "malloc")
+		return nil, err
+	}
+
+	config := withModuleKind(opts.sandbox.moduleConfig(opts.name), kind)
+	var det *deterministicEnv
+	if opts.settings.Deterministic != nil {
+		det = newDeterministicEnv(opts.settings.Deterministic)
+		config = det.apply(config)
+		log.Printf("module %q runs in deterministic mode (seed %d)", opts.name, opts.settings.Deterministic.Seed)
+	}
+
+	we := &wasmEngine{
+		rt:           rt,
+		code:         code,
+		hostMod:      hostMod,
+		config:       config,
+		name:         opts.name,
+		entrypoint:   meta.Entrypoint,
+		allocator:    needsAllocator(code),
+		stack:        make([]uint64, 16), // overkill
+		abi:          abi,
+		grants:       opts.grants,
+		det:          det,
+		budget:       opts.settings.Fuel,
+		limits:       limits,
+		moduleConfig: opts.settings.Config,
+		recycle:      opts.settings.Recycle,
+		snapshots:    opts.settings.Snapshot,
+		globals:      snapshotGlobals,
+		symbols:      symbols,
+		coredumps:    opts.coredumps,
+		digest:       digest,
 	}
-	freeFn := guestMod.ExportedFunction("free")
-	if freeFn == nil {
+	we.calls.New = we.newCallData
+	if err := we.instantiate(ctx); err != nil {
 		rt.Close(ctx) // don't leak
-		return nil, fmt.Errorf("failed to lookup function %q", "free")
+		return nil, err
+	}
+
+	for key, _ := range we.guestMod.ExportedFunctionDefinitions() {
+		log.Printf("[%s] -> %q", we.guestMod.Name(), key)
+	}
+	return we, nil
+}
+
+// instantiate creates a fresh guest instance, replacing the current one, if any.
+func (we *wasmEngine) instantiate(ctx context.Context) error {
+	var ts time.Time
+
+	if we.guestMod != nil {
+		// the name must be free for the new instance
+		we.guestMod.Close(ctx)
+		we.guestMod = nil
+	}
+
+	if we.det != nil {
+		// the initialization must see what it saw on the first instance
+		we.det.reset()
+	}
+
+	ts = time.Now()
+	cdata := we.initCallData()
+	// also invokes _start or _initialize, depending on the module kind
+	guestMod, err := we.rt.InstantiateModule(context.WithValue(ctx, callDataKey{}, cdata), we.code, we.config)
+	log.Printf("module instantiated in %v (%v)", time.Since(ts), err)
+	// most useful when the initialization failed
+	if cdata.stderr.Len() > 0 {
+		log.Printf("module stderr: [%s]", cdata.stderr.Bytes())
+	}
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() != 0 {
+			return newGuestError(errKindExit, err)
+		}
+		return newGuestError(errKindInstantiate, err)
+	}
+	if guestMod.IsClosed() {
+		// wazero reports exiting with code 0 as success
+		return newGuestError(errKindInstantiate, fmt.Errorf("%w: its main must return without exiting, or it must be built as a reactor", errCommandExited))
 	}
 
 	ts = time.Now()
-	runFn := guestMod.ExportedFunction(runFnName)
+	var mallocFn, freeFn api.Function
+	if we.allocator {
+		mallocFn = guestMod.ExportedFunction("malloc")
+		if mallocFn == nil {
+			guestMod.Close(ctx) // don't leak
+			return fmt.Errorf("failed to lookup function %q", "malloc")
+		}
+		freeFn = guestMod.ExportedFunction("free")
+		if freeFn == nil {
+			guestMod.Close(ctx) // don't leak
+			return fmt.Errorf("failed to lookup function %q", "free")
+		}
+	}
+	runFn := guestMod.ExportedFunction(we.entrypoint)
 	if runFn == nil {
-		rt.Close(ctx) // don't leak
-		return nil, fmt.Errorf("failed to lookup function %q", runFnName)
+		guestMod.Close(ctx) // don't leak
+		return fmt.Errorf("failed to lookup function %q", we.entrypoint)
 	}
 	log.Printf("function looked up in %v", time.Since(ts))
 
-	for key, _ := range guestMod.ExportedFunctionDefinitions() {
-		log.Printf("[%s] -> %q", guestMod.Name(), key)
+	var fuel api.MutableGlobal
+	if we.budget > 0 {
+		fuel, _ = guestMod.ExportedGlobal(fuelGlobalExport).(api.MutableGlobal)
+		if fuel == nil {
+			guestMod.Close(ctx) // don't leak
+			return fmt.Errorf("failed to lookup global %q", fuelGlobalExport)
+		}
+	}
+
+	var snap *memorySnapshot
+	if we.snapshots {
+		ts = time.Now()
+		snap, err = takeSnapshot(guestMod, we.globals)
+		if err != nil {
+			guestMod.Close(ctx) // don't leak
+			return err
+		}
+		log.Printf("module snapshot taken in %v (%d bytes)", time.Since(ts), len(snap.memory))
 	}
 
-	return &wasmEngine{
-		rt:       rt,
-		code:     code,
-		hostMod:  hostMod,
-		guestMod: guestMod,
-		stack:    make([]uint64, 16), // overkill
-		mallocFn: mallocFn,
-		freeFn:   freeFn,
-		runFn:    runFn,
-	}, nil
+	we.guestMod = guestMod
+	we.snapshot = snap
+	we.mallocFn = mallocFn
+	we.freeFn = freeFn
+	we.runFn = runFn
+	we.fuel = fuel
+	we.requests = 0
+	we.baseMemory = 0
+	if mem := guestMemory(guestMod); mem != nil {
+		we.baseMemory = mem.Size()
+	}
+	return nil
 }
 
-func (we *wasmEngine) Run(ctx context.Context, name string, stdin io.Reader, env map[string]string) (string, string, error) {
+// Run serves a request, writing the guest output to w if it succeeds.
+// The output is buffered: a failing guest must not send a partial response,
+// which would also commit the status before we know it. Failing to write
+// to w returns an error wrapping errResponseWrite.
+func (we *wasmEngine) Run(ctx context.Context, name string, stdin io.Reader, env map[string]string, w io.Writer) error {
 	var ts time.Time
 
-	ts = time.Now()
-	// TODO
-	guestCtx, cdata := putCallData(ctx, we)
+	cdata := we.calls.Get().(*callData)
+	defer we.putCallData(cdata)
 
-	stdinData, err := io.ReadAll(stdin)
+	truncated, err := readLimited(&cdata.input, stdin, we.limits.Body)
 	if err != nil {
-		return "", "", err
+		return err
+	}
+	if truncated {
+		log.Printf("request body truncated to %d bytes", we.limits.Body.Max)
+	}
+	log.Printf("body: %d bytes", cdata.input.Len())
+	// igets can't tell the delimiter from the body
+	cdata.input.WriteByte(we.abi.delimiter)
+	cdata.body = cdata.input.Bytes()[:cdata.input.Len()-1]
+	cdata.env = env
+
+	err = we.run(ctx, name, env, cdata)
+	// out of the engine lock: the disk may be slow
+	for _, dump := range cdata.coredumps {
+		we.writeCoredump(ctx, name, dump)
+	}
+	clear(cdata.coredumps) // don't pin the guest memory copies
+	cdata.coredumps = cdata.coredumps[:0]
+	// most useful when the guest failed
+	if cdata.stderr.Len() > 0 {
+		log.Printf("module stderr: [%s]", cdata.stderr.Bytes())
 	}
-	stdinData = append(stdinData, byte('\x00'))
-	log.Printf("stdin: [%s]", string(stdinData))
-	_, err = cdata.stdin.Write(stdinData)
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	log.Printf("module stdout: %d bytes", cdata.stdout.Len())
+
+	ts = time.Now()
+	_, err = w.Write(cdata.stdout.Bytes())
+	log.Printf("response sent in %v (%v)", time.Since(ts), err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errResponseWrite, err)
+	}
+	return nil
+}
+
+// run calls the guest, retrying on a fresh instance if allowed.
+func (we *wasmEngine) run(ctx context.Context, name string, env map[string]string, cdata *callData) error {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	if we.closed {
+		return errEngineClosed
+	}
+
+	err := we.call(ctx, name, cdata)
+	if err != nil && we.shouldRetry(err, env["HTTP_METHOD"], cdata) {
+		log.Printf("module %q: retrying %s request on a fresh instance", name, env["HTTP_METHOD"])
+		instanceRetries.Add(name, 1)
+		err = we.call(ctx, name, cdata)
+	}
+	return err
+}
+
+// call runs the entrypoint once, recycling the instance afterwards if needed.
+func (we *wasmEngine) call(ctx context.Context, name string, cdata *callData) error {
+	var ts time.Time
+
+	if we.guestMod == nil {
+		// the previous attempt to recycle failed
+		if err := we.instantiate(ctx); err != nil {
+			return err
+		}
+	}
+
+	if we.det != nil {
+		we.det.reset()
+	}
+
+	// past the deadline, the runtime closes the guest instance
+	callCtx, cancel := context.WithTimeout(ctx, we.limits.timeout)
+	defer cancel()
+
+	ts = time.Now()
+	guestCtx := cdata.prepare(callCtx, we)
 	log.Printf("run function prepared in %v", time.Since(ts))
 
+	if we.fuel != nil {
+		we.fuel.Set(uint64(we.budget))
+	}
+
 	ts = time.Now()
 	// run is like main: take no args, returns no value. Still, we pass stack explicitly because why not
-	err = we.runFn.CallWithStack(guestCtx, we.stack)
+	err := we.runFn.CallWithStack(guestCtx, we.stack)
 	log.Printf("run function executed in %v (%v)", time.Since(ts), err)
+	we.requests++
 
-	ts = time.Now()
-	dealloc(cdata)
-	log.Printf("dealloc in %v (%v)", time.Since(ts), err)
+	var trace []stackFrame
+	if err != nil {
+		trace = we.symbols.Symbolicate(err)
+		log.Printf("module %q stack trace:%s", name, formatStackTrace(trace))
+
+		var exitErr *sys.ExitError
+		if we.coredumps != nil && !errors.As(err, &exitErr) { // exited modules are gone
+			// before anything else touches the guest state; Run writes it
+			ts = time.Now()
+			cdata.coredumps = append(cdata.coredumps, buildCoredump(name, we.guestMod, we.symbols.coreFrames(err)))
+			log.Printf("module %q: core dump built in %v", name, time.Since(ts))
+		}
+	}
+
+	if we.fuel != nil {
+		if remaining := int64(we.fuel.Get()); err != nil && remaining < 0 {
+			err = fmt.Errorf("%w: budget of %d instructions", errFuelExhausted, we.budget)
+		}
+		// the host calls into the guest on its own behalf, too
+		we.fuel.Set(uint64(fuelInitial))
+	}
+
+	if err != nil {
+		ge := classifyError(err)
+		ge.Trace = trace
+		err = ge
+		// the guest state can't be trusted anymore, not even to free memory
+		we.recycleInstance(ctx, recycleReasonTrap)
+	} else if reason := we.recycleReason(); reason != "" {
+		we.recycleInstance(ctx, reason)
+	} else if we.snapshot != nil {
+		// also takes care of the allocations
+		ts = time.Now()
+		rerr := we.snapshot.restore(we.guestMod)
+		log.Printf("snapshot restored in %v (%v)", time.Since(ts), rerr)
+		if rerr != nil {
+			we.recycleInstance(ctx, recycleReasonRestore)
+		}
+	} else {
+		ts = time.Now()
+		derr := dealloc(cdata)
+		log.Printf("dealloc in %v (%v)", time.Since(ts), derr)
+	}
+
+	if cdata.stdout.truncated {
+		log.Printf("module stdout truncated to %d bytes", cdata.stdout.limit.Max)
+	}
+	if cdata.stderr.truncated {
+		log.Printf("module stderr truncated to %d bytes", cdata.stderr.limit.Max)
+	}
+	return err
+}
 
-	return cdata.stdout.String(), cdata.stderr.String(), err
+func (we *wasmEngine) writeCoredump(ctx context.Context, name string, data []byte) {
+	ts := time.Now()
+	path, err := we.coredumps.Write(requestIDFrom(ctx), we.digest, data)
+	if err != nil {
+		log.Printf("module %q: cannot write core dump: %v", name, err)
+		return
+	}
+	log.Printf("module %q: core dump written to %q (%d bytes) in %v", name, path, len(data), time.Since(ts))
+}
+
+// newHostModuleBuilder builds the host module for the given ABI version.
+func newHostModuleBuilder(rt wazero.Runtime, abi hostABI) wazero.HostModuleBuilder {
+	// all the versions so far share the functions; igets
+	// learns the delimiter to use from the call data.
+	// Unlike WithFunc, the stack based functions don't use reflection,
+	// which allocates on every call.
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	builder := rt.NewHostModuleBuilder(hostModuleName)
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = igets(ctx, mod)
+	}), nil, []api.ValueType{i64}).Export("igets")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = igetbody(ctx, mod)
+	}), nil, []api.ValueType{i64}).Export("igetbody")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = igetenv(ctx, mod)
+	}), nil, []api.ValueType{i64}).Export("igetenv")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = uint64(ireadbody(ctx, mod, uint32(stack[0]), uint32(stack[1])))
+	}), []api.ValueType{i32, i32}, []api.ValueType{i32}).Export("ireadbody")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = uint64(ireadenv(ctx, mod, uint32(stack[0]), uint32(stack[1])))
+	}), []api.ValueType{i32, i32}, []api.ValueType{i32}).Export("ireadenv")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = uint64(ireadconfig(ctx, mod, uint32(stack[0]), uint32(stack[1])))
+	}), []api.ValueType{i32, i32}, []api.ValueType{i32}).Export("ireadconfig")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		stack[0] = ijsonget(ctx, mod, uint32(stack[0]), uint32(stack[1]), uint32(stack[2]), uint32(stack[3]))
+	}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i64}).Export("ijsonget")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		eputs(ctx, mod, uint32(stack[0]), uint32(stack[1]))
+	}), []api.ValueType{i32, i32}, nil).Export("eputs")
+	builder.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+		oputs(ctx, mod, uint32(stack[0]), uint32(stack[1]))
+	}), []api.ValueType{i32, i32}, nil).Export("oputs")
+	return builder
 }
 
 func dealloc(cdata *callData) error {
 	ctx := context.Background() // TODO
 	count := 0
-	for len(cdata.allocs) > 0 {
-		ptr := cdata.allocs[0]
-		cdata.allocs = cdata.allocs[1:]
-
-		_, err := cdata.freeFn.Call(ctx, uint64(ptr))
-		if err != nil {
+	for i, ptr := range cdata.allocs {
+		cdata.stack[0] = uint64(ptr)
+		if err := cdata.freeFn.CallWithStack(ctx, cdata.stack[:]); err != nil {
+			cdata.allocs = cdata.allocs[i+1:]
 			return err
 		}
 		count++
 	}
+	cdata.allocs = cdata.allocs[:0]
 	log.Printf("dealloc: %d pointers", count)
 	return nil
 }
 
 func igets(ctx context.Context, mod api.Module) uint64 {
 	cdata := getCallData(ctx)
+	cdata.grants.Enforce("igets")
 	dealloc(cdata)
 
-	stdinData, err := cdata.stdin.ReadBytes('\x00')
-	if err != nil {
-		log.Printf("stdin readstring failed: %v", err)
+	if len(cdata.stdin) == 0 {
+		log.Printf("stdin readstring failed: %v", io.EOF)
 		return 0
 	}
+	end := bytes.IndexByte(cdata.stdin, cdata.delimiter) + 1
+	if end == 0 {
+		end = len(cdata.stdin)
+	}
+	stdinData := cdata.stdin[:end]
+	cdata.stdin = cdata.stdin[end:]
+	ptrSize, err := putGuestData(ctx, mod, cdata, stdinData)
+	if err != nil {
+		log.Printf("igets: %v", err)
+	}
+	return ptrSize
+}
 
-	results, err := cdata.mallocFn.Call(ctx, uint64(len(stdinData)))
+// igetbody returns the whole request body, as is: unlike igets, it is
+// safe for binary data. It doesn't consume the data igets reads.
+func igetbody(ctx context.Context, mod api.Module) uint64 {
+	cdata := getCallData(ctx)
+	cdata.grants.Enforce("igetbody")
+	ptrSize, err := putGuestData(ctx, mod, cdata, cdata.body)
 	if err != nil {
-		log.Printf("malloc failed: %v", err)
-		return 0
+		log.Printf("igetbody: %v", err)
+	}
+	return ptrSize
+}
+
+// igetenv returns the request environment: the method, path and so on,
+// and the request headers, as "KEY=VALUE" entries, each NUL-terminated.
+func igetenv(ctx context.Context, mod api.Module) uint64 {
+	cdata := getCallData(ctx)
+	cdata.grants.Enforce("igetenv")
+	ptrSize, err := putGuestData(ctx, mod, cdata, cdata.envData())
+	if err != nil {
+		log.Printf("igetenv: %v", err)
+	}
+	return ptrSize
+}
+
+// ireadbody is igetbody writing in the buffer the guest provides.
+func ireadbody(ctx context.Context, mod api.Module, bufPtr, bufCap uint32) uint32 {
+	cdata := getCallData(ctx)
+	cdata.grants.Enforce("ireadbody")
+	return putGuestBuffer(mod, "ireadbody", bufPtr, bufCap, cdata.body)
+}
+
+// ireadenv is igetenv writing in the buffer the guest provides.
+func ireadenv(ctx context.Context, mod api.Module, bufPtr, bufCap uint32) uint32 {
+	cdata := getCallData(ctx)
+	cdata.grants.Enforce("ireadenv")
+	return putGuestBuffer(mod, "ireadenv", bufPtr, bufCap, cdata.envData())
+}
+
+// ireadconfig writes the module configuration from the module settings,
+// empty if none, in the buffer the guest provides.
+func ireadconfig(ctx context.Context, mod api.Module, bufPtr, bufCap uint32) uint32 {
+	cdata := getCallData(ctx)
+	cdata.grants.Enforce("ireadconfig")
+	return putGuestBuffer(mod, "ireadconfig", bufPtr, bufCap, cdata.config)
+}
+
+// putGuestData copies data in memory the guest allocates, which is freed
+// after the call, and returns where it is as ptr<<32|size. On failure,
+// the host functions return 0 to the guest, like for no data.
+func putGuestData(ctx context.Context, mod api.Module, cdata *callData, data []byte) (uint64, error) {
+	if cdata.mallocFn == nil {
+		return 0, errNoAllocator
+	}
+	cdata.stack[0] = uint64(len(data))
+	if err := cdata.mallocFn.CallWithStack(ctx, cdata.stack[:]); err != nil {
+		return 0, fmt.Errorf("malloc failed: %w", err)
 	}
 
-	ptr := results[0]
-	size := uint64(len(stdinData))
+	ptr := cdata.stack[0]
+	size := uint64(len(data))
 	cdata.allocs = append(cdata.allocs, uint32(ptr))
 
-	if ok := mod.Memory().Write(uint32(ptr), stdinData); !ok {
-		log.Printf("memory write ed: %v", err)
-		return 0
+	if ok := mod.Memory().Write(uint32(ptr), data); !ok {
+		return 0, fmt.Errorf("%d bytes at %#x out of guest memory", size, ptr)
 	}
 
-	return (uint64(ptr) << uint64(32)) | uint64(size)
+	return (uint64(ptr) << uint64(32)) | uint64(size), nil
+}
+
+// putGuestBuffer copies as much of data as fits in the guest buffer, and
+// returns the size of the whole data: when it's larger than the buffer,
+// the guest must call again with one large enough.
+func putGuestBuffer(mod api.Module, fn string, bufPtr, bufCap uint32, data []byte) uint32 {
+	n := min(int(bufCap), len(data))
+	if ok := mod.Memory().Write(bufPtr, data[:n]); !ok {
+		panic(fmt.Errorf("%w: %s: buffer of %d bytes at %#x out of guest memory", errHostFunction, fn, bufCap, bufPtr))
+	}
+	return uint32(len(data))
 }
 
 func eputs(ctx context.Context, mod api.Module, bufPtr uint32, bufLen uint32) {
 	cdata := getCallData(ctx)
+	cdata.grants.Enforce("eputs")
 
 	bytes, ok := mod.Memory().Read(bufPtr, bufLen)
 	if !ok {
@@ -200,11 +677,16 @@ func eputs(ctx context.Context, mod api.Module, bufPtr uint32, bufLen uint32) {
 		return
 	}
 
-	cdata.stderr.Write(bytes)
+	if _, err := cdata.stderr.Write(bytes); err != nil {
+		panic(err) // trap: see limitedBuffer
+	}
 }
 
+// oputs copies the data straight from the guest memory to the output
+// buffer; see Run for why it can't go to the response right away.
 func oputs(ctx context.Context, mod api.Module, bufPtr uint32, bufLen uint32) {
 	cdata := getCallData(ctx)
+	cdata.grants.Enforce("oputs")
 
 	bytes, ok := mod.Memory().Read(bufPtr, bufLen)
 	if !ok {
@@ -212,17 +694,61 @@ func oputs(ctx context.Context, mod api.Module, bufPtr uint32, bufLen uint32) {
 		return
 	}
 
-	cdata.stdout.Write(bytes)
+	if _, err := cdata.stdout.Write(bytes); err != nil {
+		panic(err) // trap: see limitedBuffer
+	}
 }
 
+// callData is the state of a request. It is recycled across requests
+// through the engine pool, together with its buffers.
 type callData struct {
-	stdin    bytes.Buffer
-	stdout   bytes.Buffer
-	stderr   bytes.Buffer
+	// the request body, followed by the igets delimiter
+	input bytes.Buffer
+	// the request body as is, see igetbody
+	body []byte
+	// what igets didn't read yet
+	stdin    []byte
+	stdout   limitedBuffer
+	stderr   limitedBuffer
 	mallocFn api.Function
 	freeFn   api.Function
 	allocs   []uint32
-	// TODO: env
+	// to call mallocFn and freeFn
+	stack [1]uint64
+	// delimiter of the igets data, depends on the ABI version
+	delimiter byte
+	grants    *capabilityGrants
+	// the request environment, see igetenv
+	env map[string]string
+	// the module configuration, see ireadconfig
+	config []byte
+	// env, encoded on first use
+	envBlock   []byte
+	envEncoded bool
+	// of the failed calls, written once the engine is unlocked
+	coredumps [][]byte
+}
+
+// envData encodes the request environment for the guest.
+func (cdata *callData) envData() []byte {
+	if cdata.envEncoded {
+		return cdata.envBlock
+	}
+	keys := make([]string, 0, len(cdata.env))
+	for key := range cdata.env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	envBlock := cdata.envBlock[:0]
+	for _, key := range keys {
+		envBlock = append(envBlock, key...)
+		envBlock = append(envBlock, '=')
+		envBlock = append(envBlock, cdata.env[key]...)
+		envBlock = append(envBlock, 0)
+	}
+	cdata.envBlock = envBlock
+	cdata.envEncoded = true
+	return envBlock
 }
 
 type callDataKey struct{}
@@ -231,11 +757,60 @@ func getCallData(ctx context.Context) *callData {
 	return ctx.Value(callDataKey{}).(*callData)
 }
 
-func putCallData(ctx context.Context, we *wasmEngine) (context.Context, *callData) {
-	cdata := callData{
-		mallocFn: we.mallocFn,
-		freeFn:   we.freeFn,
+// guestMemory returns the memory of the module, nil if it has none: in
+// that case, wazero returns a nil pointer as a non-nil api.Memory.
+func guestMemory(mod api.Module) api.Memory {
+	mem := mod.Memory()
+	if mem == nil || reflect.ValueOf(mem).IsNil() {
+		return nil
+	}
+	return mem
+}
+
+func (we *wasmEngine) newCallData() any {
+	return &callData{
+		stdout: limitedBuffer{name: "stdout", limit: we.limits.Stdout},
+		stderr: limitedBuffer{name: "stderr", limit: we.limits.Stderr},
+	}
+}
+
+// initCallData returns the call data of the guest initialization: there
+// is no request, but the module can read its configuration, to reject
+// an invalid one right away, and log.
+func (we *wasmEngine) initCallData() *callData {
+	cdata := we.newCallData().(*callData)
+	cdata.delimiter = we.abi.delimiter
+	cdata.grants = we.grants
+	cdata.config = we.moduleConfig
+	return cdata
+}
+
+// prepare sets up the call data for a call to the current guest instance,
+// and returns the context to call it with. The input is left untouched,
+// so the call can be retried.
+func (cdata *callData) prepare(ctx context.Context, we *wasmEngine) context.Context {
+	cdata.mallocFn = we.mallocFn
+	cdata.freeFn = we.freeFn
+	cdata.delimiter = we.abi.delimiter
+	cdata.grants = we.grants
+	cdata.config = we.moduleConfig
+	cdata.stdin = cdata.input.Bytes()
+	cdata.stdout.Reset()
+	cdata.stderr.Reset()
+	cdata.allocs = cdata.allocs[:0]
+	return context.WithValue(ctx, callDataKey{}, cdata)
+}
+
+// putCallData recycles the call data, unless the request was unusually
+// large: the pool should not pin that much memory.
+func (we *wasmEngine) putCallData(cdata *callData) {
+	if cdata.input.Cap() > callDataMaxRecycle || cdata.stdout.Cap() > callDataMaxRecycle || cdata.stderr.Cap() > callDataMaxRecycle {
+		return
 	}
-	ctx = context.WithValue(ctx, callDataKey{}, &cdata)
-	return ctx, &cdata
+	cdata.input.Reset()
+	cdata.body = nil
+	cdata.stdin = nil
+	cdata.env = nil
+	cdata.envEncoded = false
+	we.calls.Put(cdata)
 }
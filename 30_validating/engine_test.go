@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// the engine logs every step: the tests and benchmarks would measure,
+// and drown in, the logging
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// echoCapabilities are the capabilities echoModule needs.
+var echoCapabilities = []string{"io", "body"}
+
+// echoModule builds a guest echoing the request body, up to 64 KiB,
+// through ireadbody and oputs.
+func echoModule() *testModule {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	readBody := tm.importFunc(hostModuleName, "ireadbody", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	run := tm.function(nil, nil, []api.ValueType{i32},
+		opI32Const(0), opI32Const(64<<10), opCall(readBody), opLocalSet(0),
+		opI32Const(0), opLocalGet(0), opCall(puts),
+	)
+	tm.exportFunc(runFnName, run)
+	return &tm
+}
+
+// stubAllocator adds the malloc and free exports the allocating host
+// functions need, malloc always returning address 0: good enough for
+// the guests making a single small allocation per request.
+func stubAllocator(tm *testModule) {
+	i32 := api.ValueTypeI32
+	tm.exportFunc("malloc", tm.function([]api.ValueType{i32}, []api.ValueType{i32}, nil, opI32Const(0)))
+	tm.exportFunc("free", tm.function([]api.ValueType{i32}, nil, nil))
+}
+
+func newTestEngine(tb testing.TB, wasmObj []byte, settings moduleSettings) *wasmEngine {
+	tb.Helper()
+	ctx := context.Background()
+	grants, err := newCapabilityGrants("test", settings.Capabilities)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sb, err := newSandbox(settings, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	we, err := newWasmEngine(ctx, wasmObj, engineOptions{
+		name:     "test",
+		settings: settings,
+		grants:   grants,
+		sandbox:  sb,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { we.Close(ctx) })
+	return we
+}
+
+var testRequestEnv = map[string]string{
+	"HTTP_PATH":   "/",
+	"HTTP_METHOD": "POST",
+}
+
+func TestRunEcho(t *testing.T) {
+	we := newTestEngine(t, echoModule().bytes(), moduleSettings{Capabilities: echoCapabilities})
+	body := `{"name":{"first":"John","last":"Doe"}}`
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		if err := we.Run(context.Background(), "test", strings.NewReader(body), testRequestEnv, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != body {
+			t.Fatalf("got response %q, want %q", out.String(), body)
+		}
+	}
+}
+
+// runOutput runs the guest once, and returns its output.
+func runOutput(t *testing.T, we *wasmEngine, body string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := we.Run(context.Background(), "test", strings.NewReader(body), testRequestEnv, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestReadBody(t *testing.T) {
+	i32 := api.ValueTypeI32
+	// readBodyModule writes the size ireadbody returns, then its buffer
+	readBodyModule := func(bufCap int32) []byte {
+		var tm testModule
+		readBody := tm.importFunc(hostModuleName, "ireadbody", []api.ValueType{i32, i32}, []api.ValueType{i32})
+		puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+		tm.memoryPages(1)
+		run := tm.function(nil, nil, nil,
+			opI32Const(0), opI32Const(4), opI32Const(bufCap), opCall(readBody), opI32Store(),
+			opI32Const(0), opI32Const(4+bufCap), opCall(puts),
+		)
+		tm.exportFunc(runFnName, run)
+		return tm.bytes()
+	}
+
+	body := "hello\x00world\x00"
+	tests := []struct {
+		name   string
+		body   string
+		bufCap int32
+		want   string
+	}{
+		{name: "empty", body: "", bufCap: 4, want: "\x00\x00\x00\x00"},
+		{name: "no buffer", body: body, bufCap: 0, want: ""},
+		// the guest must call again, with a buffer of the size returned
+		{name: "buffer too small", body: body, bufCap: 5, want: "hello"},
+		{name: "exact buffer", body: body, bufCap: 12, want: body},
+		{name: "larger buffer", body: body, bufCap: 16, want: body + "\x00\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := newTestEngine(t, readBodyModule(tt.bufCap), moduleSettings{Capabilities: echoCapabilities})
+			out := runOutput(t, we, tt.body)
+			if size := binary.LittleEndian.Uint32(out); int(size) != len(tt.body) {
+				t.Fatalf("got size %d, want %d", size, len(tt.body))
+			}
+			if got := string(out[4:]); got != tt.want {
+				t.Fatalf("got buffer %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBody(t *testing.T) {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	var tm testModule
+	getBody := tm.importFunc(hostModuleName, "igetbody", nil, []api.ValueType{i64})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	// what igetbody returns during the initialization, when the guest
+	// allocator can't be called
+	initResult := tm.global(i64, true, -1)
+	initialize := tm.function(nil, nil, nil, opCall(getBody), opGlobalSet(initResult))
+	run := tm.function(nil, nil, []api.ValueType{i64},
+		opCall(getBody), opLocalSet(0),
+		// ptr<<32|size
+		opLocalGet(0), opI64Const(32), []byte{0x88, 0xa7}, // i64.shr_u, i32.wrap_i64
+		opLocalGet(0), []byte{0xa7},
+		opCall(puts),
+	)
+	tm.exportFunc(reactorInitFn, initialize)
+	tm.exportFunc(runFnName, run)
+	tm.exportGlobal("init_result", initResult)
+	stubAllocator(&tm)
+	we := newTestEngine(t, tm.bytes(), moduleSettings{Capabilities: echoCapabilities})
+
+	if got := we.guestMod.ExportedGlobal("init_result").Get(); got != 0 {
+		t.Fatalf("initialization: got %#x, want 0", got)
+	}
+	// unlike igets, igetbody doesn't stop at the delimiter
+	for _, body := range []string{"", "hello", "a\x00b\x00\x00c\n"} {
+		if got := runOutput(t, we, body); string(got) != body {
+			t.Fatalf("got body %q, want %q", got, body)
+		}
+	}
+}
+
+func TestPutGuestDataWithoutAllocator(t *testing.T) {
+	var cdata callData
+	if _, err := putGuestData(context.Background(), nil, &cdata, []byte("data")); !errors.Is(err, errNoAllocator) {
+		t.Fatalf("got error %v, want %v", err, errNoAllocator)
+	}
+}
+
+// benchmarkRun measures serving a request, from the request body to the
+// response. Run them with:
+//
+//	go test -run '^$' -bench Run -benchmem
+//
+// Most of the allocations come from the per-request deadline: the timer
+// context, and the goroutine wazero starts to stop the guest when the
+// context is done.
+func benchmarkRun(b *testing.B, body []byte) {
+	we := newTestEngine(b, echoModule().bytes(), moduleSettings{Capabilities: echoCapabilities})
+	ctx := context.Background()
+	var rd bytes.Reader // only the engine allocations count
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for b.Loop() {
+		rd.Reset(body)
+		if err := we.Run(ctx, "test", &rd, testRequestEnv, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunSmallBody(b *testing.B) {
+	benchmarkRun(b, []byte(`{"name":{"first":"John","last":"Doe"},"age":42}`))
+}
+
+func BenchmarkRunLargeBody(b *testing.B) {
+	benchmarkRun(b, bytes.Repeat([]byte("x"), 32<<10))
+}
+
+// the instance is shared: the requests queue on it
+func BenchmarkRunParallel(b *testing.B) {
+	we := newTestEngine(b, echoModule().bytes(), moduleSettings{Capabilities: echoCapabilities})
+	body := []byte(`{"name":{"first":"John","last":"Doe"},"age":42}`)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var rd bytes.Reader
+		for pb.Next() {
+			rd.Reset(body)
+			if err := we.Run(ctx, "test", &rd, testRequestEnv, io.Discard); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
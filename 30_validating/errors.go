@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// the kinds of guest failures
+const (
+	errKindCompile       = "compile"
+	errKindInstantiate   = "instantiate"
+	errKindTrap          = "trap"
+	errKindExit          = "exit"
+	errKindTimeout       = "timeout"
+	errKindResourceLimit = "resource-limit"
+	errKindHostFunction  = "host-function"
+	errKindBodyTooLarge  = "body-too-large"
+	errKindBodyRead      = "body-read"
+
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:httpwasm:problem:"
+)
+
+// host functions panic with errors wrapping errHostFunction to fail the
+// guest call; wazero preserves the wrapping.
+var errHostFunction = errors.New("host function failed")
+
+type problemKind struct {
+	status int
+	title  string
+}
+
+var problemKinds = map[string]problemKind{
+	errKindCompile:       {http.StatusInternalServerError, "Module compilation failed"},
+	errKindInstantiate:   {http.StatusInternalServerError, "Module instantiation failed"},
+	errKindTrap:          {http.StatusInternalServerError, "Module trapped"},
+	errKindExit:          {http.StatusBadGateway, "Module exited"},
+	errKindTimeout:       {http.StatusGatewayTimeout, "Module timed out"},
+	errKindResourceLimit: {http.StatusServiceUnavailable, "Module exceeded a resource limit"},
+	errKindHostFunction:  {http.StatusInternalServerError, "Host function failed"},
+	errKindBodyTooLarge:  {http.StatusRequestEntityTooLarge, "Request body too large"},
+	errKindBodyRead:      {http.StatusBadRequest, "Request body unreadable"},
+}
+
+// guestError is a failure of the guest, classified by kind.
+type guestError struct {
+	Kind     string
+	ExitCode uint32 // meaningful only for errKindExit
+	Err      error
+	// the symbolicated guest stack, if available
+	Trace []stackFrame
+}
+
+func (ge *guestError) Error() string {
+	return fmt.Sprintf("%s: %v", ge.Kind, ge.Err)
+}
+
+func (ge *guestError) Unwrap() error {
+	return ge.Err
+}
+
+func newGuestError(kind string, err error) *guestError {
+	ge := guestError{
+		Kind: kind,
+		Err:  err,
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		ge.ExitCode = exitErr.ExitCode()
+	}
+	return &ge
+}
+
+// classifyError returns the guestError describing err, which is
+// any error returned by a guest call.
+func classifyError(err error) *guestError {
+	var ge *guestError
+	if errors.As(err, &ge) {
+		return ge
+	}
+	var exitErr *sys.ExitError
+	hasExit := errors.As(err, &exitErr)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return newGuestError(errKindBodyTooLarge, err)
+	case errors.Is(err, errBodyRead):
+		// most likely, the client went away
+		return newGuestError(errKindBodyRead, err)
+	case errors.Is(err, errFuelExhausted), errors.Is(err, errOutputTooLarge):
+		return newGuestError(errKindResourceLimit, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled),
+		hasExit && (exitErr.ExitCode() == sys.ExitCodeDeadlineExceeded || exitErr.ExitCode() == sys.ExitCodeContextCanceled):
+		return newGuestError(errKindTimeout, err)
+	case hasExit:
+		return newGuestError(errKindExit, err)
+	case errors.Is(err, errHostFunction):
+		return newGuestError(errKindHostFunction, err)
+	}
+	return newGuestError(errKindTrap, err)
+}
+
+// errorSettings controls how guest failures are reported to clients.
+type errorSettings struct {
+	// Status overrides the HTTP status code of the given error kinds.
+	Status map[string]int `json:"status,omitempty"`
+	// Expose adds the error details to the responses. They may leak
+	// internals of the module or the host: meant for debugging only.
+	Expose bool `json:"expose,omitempty"`
+}
+
+// problemPolicy turns guest failures into RFC 9457 problem details.
+type problemPolicy struct {
+	status map[string]int
+	expose bool
+}
+
+func newProblemPolicy(es errorSettings) (*problemPolicy, error) {
+	pp := problemPolicy{
+		status: make(map[string]int),
+		expose: es.Expose,
+	}
+	for kind, pk := range problemKinds {
+		pp.status[kind] = pk.status
+	}
+	for kind, status := range es.Status {
+		if _, ok := problemKinds[kind]; !ok {
+			return nil, fmt.Errorf("unknown error kind %q", kind)
+		}
+		if status < 400 || status > 599 {
+			return nil, fmt.Errorf("error kind %q: status %d is not an error", kind, status)
+		}
+		pp.status[kind] = status
+	}
+	return &pp, nil
+}
+
+// problem is a RFC 9457 problem details object.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// extensions
+	Module    string       `json:"module,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	ExitCode  *uint32      `json:"exitCode,omitempty"`
+	Trace     []stackFrame `json:"trace,omitempty"`
+}
+
+func (pp *problemPolicy) Problem(name string, r *http.Request, err error) problem {
+	ge := classifyError(err)
+	pb := problem{
+		Type:      problemTypePrefix + ge.Kind,
+		Title:     problemKinds[ge.Kind].title,
+		Status:    pp.status[ge.Kind],
+		Instance:  r.URL.Path,
+		Module:    name,
+		RequestID: requestIDFrom(r.Context()),
+	}
+	if ge.Kind == errKindExit {
+		pb.ExitCode = &ge.ExitCode
+	}
+	if pp.expose {
+		// the trace, if any, is reported in a structured way
+		pb.Detail, _, _ = strings.Cut(ge.Err.Error(), wazeroTraceHeader)
+		pb.Trace = ge.Trace
+	}
+	return pb
+}
+
+// WriteError reports the guest failure to the client. The full error
+// is always logged.
+func (pp *problemPolicy) WriteError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	pb := pp.Problem(name, r, err)
+	log.Printf("module %q failed (%s, status %d): %v", name, pb.Type, pb.Status, err)
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(pb.Status)
+	json.NewEncoder(w).Encode(pb)
+}
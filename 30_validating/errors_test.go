@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantKind string
+	}{
+		{name: "trap", err: errors.New("wasm error: unreachable"), wantKind: errKindTrap},
+		{name: "exit", err: sys.NewExitError(3), wantKind: errKindExit},
+		{name: "deadline exit", err: sys.NewExitError(sys.ExitCodeDeadlineExceeded), wantKind: errKindTimeout},
+		{name: "canceled exit", err: sys.NewExitError(sys.ExitCodeContextCanceled), wantKind: errKindTimeout},
+		{name: "deadline", err: fmt.Errorf("calling: %w", context.DeadlineExceeded), wantKind: errKindTimeout},
+		{name: "fuel", err: fmt.Errorf("%w: budget of 10 instructions", errFuelExhausted), wantKind: errKindResourceLimit},
+		{name: "output", err: fmt.Errorf("stdout: %w", errOutputTooLarge), wantKind: errKindResourceLimit},
+		{name: "host function", err: fmt.Errorf("%w: oputs: out of range", errHostFunction), wantKind: errKindHostFunction},
+		{name: "body too large", err: fmt.Errorf("%w: more than 10 bytes", errBodyTooLarge), wantKind: errKindBodyTooLarge},
+		{name: "body read", err: fmt.Errorf("%w: %w", errBodyRead, io.ErrUnexpectedEOF), wantKind: errKindBodyRead},
+		{name: "classified", err: fmt.Errorf("run: %w", newGuestError(errKindCompile, errors.New("bad"))), wantKind: errKindCompile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ge := classifyError(tt.err)
+			if ge.Kind != tt.wantKind {
+				t.Fatalf("got kind %q, want %q", ge.Kind, tt.wantKind)
+			}
+			if _, ok := problemKinds[ge.Kind]; !ok {
+				t.Fatalf("kind %q has no problem", ge.Kind)
+			}
+		})
+	}
+
+	if ge := classifyError(sys.NewExitError(3)); ge.ExitCode != 3 {
+		t.Fatalf("got exit code %d, want 3", ge.ExitCode)
+	}
+}
+
+func TestNewProblemPolicy(t *testing.T) {
+	pp, err := newProblemPolicy(errorSettings{Status: map[string]int{errKindTrap: http.StatusBadGateway}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp.status[errKindTrap] != http.StatusBadGateway || pp.status[errKindTimeout] != http.StatusGatewayTimeout {
+		t.Fatalf("got statuses %v", pp.status)
+	}
+
+	for name, es := range map[string]errorSettings{
+		"unknown kind": {Status: map[string]int{"oops": http.StatusBadGateway}},
+		"not an error": {Status: map[string]int{errKindTrap: http.StatusOK}},
+	} {
+		if _, err := newProblemPolicy(es); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+func TestProblemPolicyWriteError(t *testing.T) {
+	guestErr := fmt.Errorf("%w: secret details", errFuelExhausted)
+	for _, expose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("expose=%v", expose), func(t *testing.T) {
+			pp, err := newProblemPolicy(errorSettings{Expose: expose})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			pp.WriteError(rec, httptest.NewRequest(http.MethodPost, "/validate", nil), "validate", guestErr)
+
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("got status %d", rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != problemContentType {
+				t.Fatalf("got content type %q", ct)
+			}
+			var pb problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &pb); err != nil {
+				t.Fatal(err)
+			}
+			if pb.Type != problemTypePrefix+errKindResourceLimit || pb.Instance != "/validate" || pb.Module != "validate" {
+				t.Fatalf("got problem %+v", pb)
+			}
+			if exposed := strings.Contains(pb.Detail, "secret details"); exposed != expose {
+				t.Fatalf("got detail %q", pb.Detail)
+			}
+		})
+	}
+}
+
+func TestEngineClassifiesFailures(t *testing.T) {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	// traps, unless the body is empty, and then writes nothing
+	var tm testModule
+	gets := tm.importFunc(hostModuleName, "igets", nil, []api.ValueType{i64})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	run := tm.function(nil, nil, nil,
+		// the size includes the delimiter
+		opCall(gets), []byte{0xa7}, opI32Const(1), []byte{0x4b}, // i32.wrap_i64, i32.gt_u
+		[]byte{0x04, 0x40, 0x00, 0x0b}, // if: unreachable, end
+		opI32Const(0), opI32Const(0), opCall(puts),
+	)
+	tm.exportFunc(runFnName, run)
+	stubAllocator(&tm)
+	we := newTestEngine(t, tm.bytes(), moduleSettings{})
+
+	tests := []struct {
+		name     string
+		body     io.Reader
+		grants   []string
+		wantKind string
+	}{
+		{name: "trap", body: strings.NewReader("boom"), grants: defaultCapabilities, wantKind: errKindTrap},
+		// revoked after the module was loaded
+		{name: "host function", body: strings.NewReader(""), grants: []string{"igets"}, wantKind: errKindHostFunction},
+		{name: "body read", body: iotest.ErrReader(io.ErrUnexpectedEOF), grants: defaultCapabilities, wantKind: errKindBodyRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := we.grants.Set(tt.grants); err != nil {
+				t.Fatal(err)
+			}
+			err := we.Run(context.Background(), "test", tt.body, testRequestEnv, io.Discard)
+			if ge := classifyError(err); ge.Kind != tt.wantKind {
+				t.Fatalf("got error %v, want a %s one", err, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestEngineDeadline(t *testing.T) {
+	var tm testModule
+	run := tm.function(nil, nil, nil, opLoopForever())
+	tm.exportFunc(runFnName, run)
+	we := newTestEngine(t, tm.bytes(), moduleSettings{Limits: limitsSettings{Timeout: "50ms"}})
+
+	for range 2 { // the instance closed on the deadline is replaced
+		err := we.Run(context.Background(), "test", strings.NewReader(""), testRequestEnv, io.Discard)
+		if ge := classifyError(err); ge.Kind != errKindTimeout {
+			t.Fatalf("got error %v, want a %s one", err, errKindTimeout)
+		}
+	}
+}
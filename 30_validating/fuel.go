@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+const (
+	// the instrumented module exports the remaining fuel with this name
+	fuelGlobalExport = "httpwasm.fuel"
+	// the fuel the module gets during instantiation, before the host can
+	// set any budget: initialization is trusted not to loop forever
+	fuelInitial = math.MaxInt64
+)
+
+var (
+	errFuelExhausted = errors.New("fuel exhausted")
+	errWasmMalformed = errors.New("malformed wasm binary")
+)
+
+// wasm section ids we care about
+const (
+	wasmSectionCustom    = 0
+	wasmSectionImport    = 2
+	wasmSectionGlobal    = 6
+	wasmSectionExport    = 7
+	wasmSectionStart     = 8
+	wasmSectionCode      = 10
+	wasmSectionDataCount = 12
+)
+
+// wasmSectionOrder is the position of each known (non-custom) section
+// in a valid binary; data count sits between element and code.
+var wasmSectionOrder = map[byte]int{
+	1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9,
+	wasmSectionDataCount: 10, 10: 11, 11: 12,
+}
+
+type wasmSection struct {
+	id      byte
+	payload []byte
+}
+
+// instrumentFuel rewrites the binary so that it consumes fuel as it runs.
+// A new mutable i64 global, exported as fuelGlobalExport, holds the fuel.
+// At each function entry and loop header we charge the number of
+// instructions of the code that follows, up to the next loop header,
+// and trap with "unreachable" if the fuel goes negative.
+// The charge is an upper-bound estimate, not an exact count: a region is
+// paid for up front, so the code skipped by an early branch out of it,
+// a return or the arm of an if not taken is charged as if it ran.
+// Function and global indices are unchanged, since the global is appended.
+// The DWARF sections are dropped: they describe the original code, so
+// the runtime would resolve wrong source locations from them.
+func instrumentFuel(wasmObj []byte) ([]byte, error) {
+	sections, err := parseWasmSections(wasmObj)
+	if err != nil {
+		return nil, err
+	}
+	sections = slices.DeleteFunc(sections, isDebugSection)
+
+	importedGlobals := 0
+	definedGlobals := 0
+	for _, sec := range sections {
+		switch sec.id {
+		case wasmSectionImport:
+			var imports importCounts
+			imports, err = countImports(sec.payload)
+			importedGlobals = imports.globals
+		case wasmSectionGlobal:
+			definedGlobals, err = vecCount(sec.payload)
+		case wasmSectionExport:
+			_, err = vecCount(sec.payload) // make sure we can append
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	fuelIdx := uint32(importedGlobals + definedGlobals)
+
+	var fuelGlobal []byte
+	fuelGlobal = append(fuelGlobal, 0x7e, 0x01) // i64, mutable
+	fuelGlobal = append(fuelGlobal, 0x42)       // i64.const
+	fuelGlobal = appendSleb(fuelGlobal, fuelInitial)
+	fuelGlobal = append(fuelGlobal, 0x0b) // end
+
+	var fuelExport []byte
+	fuelExport = appendName(fuelExport, fuelGlobalExport)
+	fuelExport = append(fuelExport, 0x03) // global
+	fuelExport = binary.AppendUvarint(fuelExport, uint64(fuelIdx))
+
+	sections = appendToVecSection(sections, wasmSectionGlobal, fuelGlobal)
+	sections = appendToVecSection(sections, wasmSectionExport, fuelExport)
+
+	for i := range sections {
+		if sections[i].id != wasmSectionCode {
+			continue
+		}
+		sections[i].payload, err = instrumentCode(sections[i].payload, fuelIdx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encodeWasmSections(sections, len(wasmObj)*2), nil
+}
+
+func isDebugSection(sec wasmSection) bool {
+	return sec.id == wasmSectionCustom && strings.HasPrefix(customSectionName(sec.payload), debugSectionPrefix)
+}
+
+// encodeWasmSections serializes the sections into a wasm binary.
+func encodeWasmSections(sections []wasmSection, sizeHint int) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, sizeHint))
+	out.Write(wasmHeader)
+	for _, sec := range sections {
+		out.WriteByte(sec.id)
+		out.Write(binary.AppendUvarint(nil, uint64(len(sec.payload))))
+		out.Write(sec.payload)
+	}
+	return out.Bytes()
+}
+
+func parseWasmSections(wasmObj []byte) ([]wasmSection, error) {
+	if !bytes.HasPrefix(wasmObj, wasmHeader) {
+		return nil, fmt.Errorf("%w: bad header", errWasmMalformed)
+	}
+	var sections []wasmSection
+	rd := wasmReader{data: wasmObj, pos: len(wasmHeader)}
+	for !rd.done() {
+		id, err := rd.byte()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := rd.bytes()
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, wasmSection{id: id, payload: payload})
+	}
+	return sections, nil
+}
+
+// appendToVecSection adds an entry to a section which is a vector,
+// creating the section in the right place if missing.
+func appendToVecSection(sections []wasmSection, id byte, entry []byte) []wasmSection {
+	for i, sec := range sections {
+		if sec.id != id {
+			continue
+		}
+		rd := wasmReader{data: sec.payload}
+		count, _ := rd.u32() // already validated
+		payload := binary.AppendUvarint(nil, uint64(count+1))
+		payload = append(payload, sec.payload[rd.pos:]...)
+		payload = append(payload, entry...)
+		sections[i].payload = payload
+		return sections
+	}
+
+	payload := binary.AppendUvarint(nil, 1)
+	payload = append(payload, entry...)
+	return insertSection(sections, wasmSection{id: id, payload: payload})
+}
+
+// insertSection adds the section in the right place.
+func insertSection(sections []wasmSection, newSec wasmSection) []wasmSection {
+	pos := len(sections)
+	for i, sec := range sections {
+		if order, ok := wasmSectionOrder[sec.id]; ok && order > wasmSectionOrder[newSec.id] {
+			pos = i
+			break
+		}
+	}
+	sections = append(sections, wasmSection{})
+	copy(sections[pos+1:], sections[pos:])
+	sections[pos] = newSec
+	return sections
+}
+
+func vecCount(payload []byte) (int, error) {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	return int(count), err
+}
+
+type importCounts struct {
+	funcs, tables, memories, globals int
+}
+
+// countImports returns how many entities of each kind the module imports.
+func countImports(payload []byte) (importCounts, error) {
+	var counts importCounts
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return counts, err
+	}
+	for i := uint32(0); i < count; i++ {
+		if _, err := rd.bytes(); err != nil { // module
+			return counts, err
+		}
+		if _, err := rd.bytes(); err != nil { // name
+			return counts, err
+		}
+		kind, err := rd.byte()
+		if err != nil {
+			return counts, err
+		}
+		switch kind {
+		case 0x00: // func
+			counts.funcs++
+			_, err = rd.u32()
+		case 0x01: // table
+			counts.tables++
+			if _, err = rd.byte(); err == nil {
+				err = rd.skipLimits()
+			}
+		case 0x02: // memory
+			counts.memories++
+			err = rd.skipLimits()
+		case 0x03: // global
+			counts.globals++
+			_, err = rd.byte()
+			if err == nil {
+				_, err = rd.byte()
+			}
+		default:
+			err = fmt.Errorf("%w: unknown import kind %#x", errWasmMalformed, kind)
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+func instrumentCode(payload []byte, fuelIdx uint32) ([]byte, error) {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	out := binary.AppendUvarint(nil, uint64(count))
+	for i := uint32(0); i < count; i++ {
+		body, err := rd.bytes()
+		if err != nil {
+			return nil, err
+		}
+		newBody, err := instrumentBody(body, fuelIdx)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		out = binary.AppendUvarint(out, uint64(len(newBody)))
+		out = append(out, newBody...)
+	}
+	return out, nil
+}
+
+// instrumentBody does two passes: the first finds the loop headers and
+// how many instructions each region has, the second injects the checks.
+func instrumentBody(body []byte, fuelIdx uint32) ([]byte, error) {
+	rd := wasmReader{data: body}
+	localsCount, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < localsCount; i++ {
+		if _, err := rd.u32(); err != nil {
+			return nil, err
+		}
+		if _, err := rd.byte(); err != nil {
+			return nil, err
+		}
+	}
+	codeStart := rd.pos
+
+	// region 0 is the function entry, then one region per loop
+	costs := []int64{0}
+	var loopEnds []int // offsets right after each loop blocktype
+	// for each open block: the region it charges to
+	stack := []int{0}
+	for len(stack) > 0 {
+		if rd.done() {
+			return nil, fmt.Errorf("%w: unterminated function body", errWasmMalformed)
+		}
+		op, err := rd.byte()
+		if err != nil {
+			return nil, err
+		}
+		region := stack[len(stack)-1]
+		costs[region]++
+
+		switch op {
+		case 0x02, 0x04: // block, if
+			if err := rd.skipBlockType(); err != nil {
+				return nil, err
+			}
+			stack = append(stack, region)
+		case 0x03: // loop
+			if err := rd.skipBlockType(); err != nil {
+				return nil, err
+			}
+			loopEnds = append(loopEnds, rd.pos)
+			costs = append(costs, 0)
+			stack = append(stack, len(costs)-1)
+		case 0x0b: // end
+			stack = stack[:len(stack)-1]
+		default:
+			if err := rd.skipImmediates(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !rd.done() {
+		return nil, fmt.Errorf("%w: trailing bytes after function body", errWasmMalformed)
+	}
+
+	out := make([]byte, 0, len(body)+(len(loopEnds)+1)*24)
+	out = append(out, body[:codeStart]...)
+	out = appendFuelCheck(out, fuelIdx, costs[0])
+	prev := codeStart
+	for i, pos := range loopEnds {
+		out = append(out, body[prev:pos]...)
+		out = appendFuelCheck(out, fuelIdx, costs[i+1])
+		prev = pos
+	}
+	out = append(out, body[prev:]...)
+	return out, nil
+}
+
+// appendFuelCheck emits a stack-neutral sequence:
+//
+//	fuel -= cost
+//	if fuel < 0 { unreachable }
+func appendFuelCheck(out []byte, fuelIdx uint32, cost int64) []byte {
+	out = append(out, 0x23) // global.get
+	out = binary.AppendUvarint(out, uint64(fuelIdx))
+	out = append(out, 0x42) // i64.const
+	out = appendSleb(out, cost)
+	out = append(out, 0x7d) // i64.sub
+	out = append(out, 0x24) // global.set
+	out = binary.AppendUvarint(out, uint64(fuelIdx))
+	out = append(out, 0x23) // global.get
+	out = binary.AppendUvarint(out, uint64(fuelIdx))
+	out = append(out, 0x42, 0x00) // i64.const 0
+	out = append(out, 0x53)       // i64.lt_s
+	out = append(out, 0x04, 0x40) // if (empty)
+	out = append(out, 0x00)       // unreachable
+	out = append(out, 0x0b)       // end
+	return out
+}
+
+func appendSleb(out []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func appendName(out []byte, name string) []byte {
+	out = binary.AppendUvarint(out, uint64(len(name)))
+	return append(out, name...)
+}
+
+// wasmReader decodes the primitive wasm encodings.
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+func (rd *wasmReader) done() bool {
+	return rd.pos >= len(rd.data)
+}
+
+func (rd *wasmReader) byte() (byte, error) {
+	if rd.done() {
+		return 0, fmt.Errorf("%w: unexpected end", errWasmMalformed)
+	}
+	b := rd.data[rd.pos]
+	rd.pos++
+	return b, nil
+}
+
+func (rd *wasmReader) u32() (uint32, error) {
+	v, n := binary.Uvarint(rd.data[rd.pos:])
+	if n <= 0 || v > math.MaxUint32 {
+		return 0, fmt.Errorf("%w: bad u32 at offset %d", errWasmMalformed, rd.pos)
+	}
+	rd.pos += n
+	return uint32(v), nil
+}
+
+// sleb skips a signed LEB128 of at most maxBytes bytes.
+func (rd *wasmReader) sleb(maxBytes int) error {
+	for i := 0; i < maxBytes; i++ {
+		b, err := rd.byte()
+		if err != nil {
+			return err
+		}
+		if b&0x80 == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: bad signed integer at offset %d", errWasmMalformed, rd.pos)
+}
+
+func (rd *wasmReader) skip(n int) error {
+	if len(rd.data)-rd.pos < n {
+		return fmt.Errorf("%w: unexpected end", errWasmMalformed)
+	}
+	rd.pos += n
+	return nil
+}
+
+// bytes reads a length-prefixed byte vector, like names and sections.
+func (rd *wasmReader) bytes() ([]byte, error) {
+	size, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	start := rd.pos
+	if err := rd.skip(int(size)); err != nil {
+		return nil, err
+	}
+	return rd.data[start:rd.pos], nil
+}
+
+// skipConstExpr skips a constant expression, like global initializers.
+func (rd *wasmReader) skipConstExpr() error {
+	for {
+		op, err := rd.byte()
+		if err != nil {
+			return err
+		}
+		if op == 0x0b { // end
+			return nil
+		}
+		if err := rd.skipImmediates(op); err != nil {
+			return err
+		}
+	}
+}
+
+func (rd *wasmReader) skipLimits() error {
+	flags, err := rd.byte()
+	if err != nil {
+		return err
+	}
+	if _, err := rd.u32(); err != nil {
+		return err
+	}
+	if flags&0x01 != 0 {
+		_, err = rd.u32()
+	}
+	return err
+}
+
+func (rd *wasmReader) skipBlockType() error {
+	if rd.done() {
+		return fmt.Errorf("%w: unexpected end", errWasmMalformed)
+	}
+	switch rd.data[rd.pos] {
+	case 0x40, 0x7f, 0x7e, 0x7d, 0x7c, 0x7b, 0x70, 0x6f:
+		rd.pos++
+		return nil
+	}
+	return rd.sleb(5) // type index, as s33
+}
+
+func (rd *wasmReader) skipImmediates(op byte) error {
+	var err error
+	switch {
+	case op == 0x0c || op == 0x0d: // br, br_if
+		_, err = rd.u32()
+	case op == 0x0e: // br_table
+		var count uint32
+		count, err = rd.u32()
+		for i := uint32(0); err == nil && i <= count; i++ {
+			_, err = rd.u32()
+		}
+	case op == 0x10: // call
+		_, err = rd.u32()
+	case op == 0x11: // call_indirect
+		if _, err = rd.u32(); err == nil {
+			_, err = rd.u32()
+		}
+	case op == 0x1c: // select t*
+		var count uint32
+		count, err = rd.u32()
+		if err == nil {
+			err = rd.skip(int(count))
+		}
+	case op >= 0x20 && op <= 0x26: // local.*, global.*, table.get/set
+		_, err = rd.u32()
+	case op >= 0x28 && op <= 0x3e: // loads and stores: memarg
+		if _, err = rd.u32(); err == nil {
+			_, err = rd.u32()
+		}
+	case op == 0x3f || op == 0x40: // memory.size, memory.grow
+		err = rd.skip(1)
+	case op == 0x41: // i32.const
+		err = rd.sleb(5)
+	case op == 0x42: // i64.const
+		err = rd.sleb(10)
+	case op == 0x43: // f32.const
+		err = rd.skip(4)
+	case op == 0x44: // f64.const
+		err = rd.skip(8)
+	case op == 0xd0: // ref.null
+		err = rd.skip(1)
+	case op == 0xd2: // ref.func
+		_, err = rd.u32()
+	case op == 0xfc:
+		err = rd.skipMiscImmediates()
+	case op <= 0x01, op == 0x05, op == 0x0f, op == 0x1a, op == 0x1b, op >= 0x45 && op <= 0xc4, op == 0xd1:
+		// no immediates
+	default:
+		err = fmt.Errorf("unsupported opcode %#x at offset %d", op, rd.pos-1)
+	}
+	return err
+}
+
+// skipMiscImmediates handles the 0xfc prefixed opcodes: saturating
+// truncations, bulk memory and table operations.
+func (rd *wasmReader) skipMiscImmediates() error {
+	subOp, err := rd.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case subOp <= 7: // trunc_sat
+		return nil
+	case subOp == 8: // memory.init
+		if _, err := rd.u32(); err != nil {
+			return err
+		}
+		return rd.skip(1)
+	case subOp == 9 || subOp == 13: // data.drop, elem.drop
+		_, err = rd.u32()
+		return err
+	case subOp == 10: // memory.copy
+		return rd.skip(2)
+	case subOp == 11: // memory.fill
+		return rd.skip(1)
+	case subOp == 12 || subOp == 14: // table.init, table.copy
+		if _, err := rd.u32(); err != nil {
+			return err
+		}
+		_, err = rd.u32()
+		return err
+	case subOp >= 15 && subOp <= 17: // table.grow, table.size, table.fill
+		_, err = rd.u32()
+		return err
+	}
+	return fmt.Errorf("unsupported opcode 0xfc %d at offset %d", subOp, rd.pos)
+}
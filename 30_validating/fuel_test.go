@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// countdownModule exports "countdown", looping as many times as its
+// argument says, and "counter", a global unrelated to the fuel.
+func countdownModule() []byte {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	tm.importFunc("env", "unused", nil, nil)
+	counter := tm.global(i32, true, 7)
+	countdown := tm.function([]api.ValueType{i32}, nil, nil,
+		[]byte{0x03, 0x40}, // loop
+		opLocalGet(0), opI32Const(1),
+		[]byte{0x6b},       // i32.sub
+		[]byte{0x22, 0x00}, // local.tee 0
+		[]byte{0x0d, 0x00}, // br_if 0
+		[]byte{0x0b},       // end
+	)
+	tm.exportFunc("countdown", countdown)
+	tm.exportGlobal("counter", counter)
+	return tm.bytes()
+}
+
+func instantiateFueled(t *testing.T, wasmObj []byte) (api.Module, api.MutableGlobal) {
+	t.Helper()
+	ctx := context.Background()
+	instrumented, err := instrumentFuel(wasmObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := wazero.NewRuntime(ctx)
+	t.Cleanup(func() { rt.Close(ctx) })
+	if _, err := rt.NewHostModuleBuilder("env").
+		NewFunctionBuilder().WithFunc(func() {}).Export("unused").
+		Instantiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := rt.Instantiate(ctx, instrumented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fuel, ok := mod.ExportedGlobal(fuelGlobalExport).(api.MutableGlobal)
+	if !ok {
+		t.Fatalf("no mutable %s global", fuelGlobalExport)
+	}
+	return mod, fuel
+}
+
+func TestInstrumentFuel(t *testing.T) {
+	ctx := context.Background()
+	mod, fuel := instantiateFueled(t, countdownModule())
+	countdown := mod.ExportedFunction("countdown")
+
+	if got := mod.ExportedGlobal("counter").Get(); got != 7 {
+		t.Fatalf("the global indices moved: counter is %d, want 7", got)
+	}
+
+	fuel.Set(1000)
+	if _, err := countdown.Call(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	used := 1000 - int64(fuel.Get())
+	if used <= 10 || used >= 1000 {
+		t.Fatalf("10 iterations used %d fuel", used)
+	}
+
+	// the cost grows with the iterations
+	fuel.Set(1000)
+	if _, err := countdown.Call(ctx, 20); err != nil {
+		t.Fatal(err)
+	}
+	if used20 := 1000 - int64(fuel.Get()); used20 <= used {
+		t.Fatalf("20 iterations used %d fuel, 10 used %d", used20, used)
+	}
+
+	fuel.Set(uint64(used - 1))
+	if _, err := countdown.Call(ctx, 10); err == nil {
+		t.Fatal("ran out of fuel without trapping")
+	}
+	if remaining := int64(fuel.Get()); remaining >= 0 {
+		t.Fatalf("trapped with %d fuel left", remaining)
+	}
+}
+
+func TestInstrumentFuelStopsEndlessLoops(t *testing.T) {
+	var tm testModule
+	spin := tm.function(nil, nil, nil, opLoopForever())
+	tm.exportFunc("spin", spin)
+	mod, fuel := instantiateFueled(t, tm.bytes())
+
+	fuel.Set(1 << 20)
+	if _, err := mod.ExportedFunction("spin").Call(context.Background()); err == nil {
+		t.Fatal("endless loop returned")
+	}
+}
+
+func TestInstrumentFuelDropsDebugSections(t *testing.T) {
+	var tm testModule
+	tm.function(nil, nil, nil)
+	tm.custom(".debug_info", []byte{1, 2, 3})
+	tm.custom(".debug_line", []byte{4, 5, 6})
+	tm.custom("name", []byte{})
+	tm.custom(metaSectionName, []byte(`{}`))
+
+	instrumented, err := instrumentFuel(tm.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections, err := parseWasmSections(instrumented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var customs []string
+	for _, sec := range sections {
+		if sec.id == wasmSectionCustom {
+			customs = append(customs, customSectionName(sec.payload))
+		}
+	}
+	if want := []string{"name", metaSectionName}; !slices.Equal(customs, want) {
+		t.Fatalf("got custom sections %v, want %v", customs, want)
+	}
+}
+
+func TestInstrumentFuelRejectsMalformed(t *testing.T) {
+	wasmObj := countdownModule()
+	for _, size := range []int{4, len(wasmHeader) + 3, len(wasmObj) - 1} {
+		if _, err := instrumentFuel(wasmObj[:size]); err == nil {
+			t.Errorf("truncated to %d bytes: instrumented", size)
+		}
+	}
+}
+
+// digitsModule is a guest like the real ones: "digits" scans its input
+// in a loop, calling a helper on each byte and returning early on the
+// first one which isn't a digit. "run" applies it to the request body.
+func digitsModule() *testModule {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	readBody := tm.importFunc(hostModuleName, "ireadbody", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(2)
+	isDigit := tm.function([]api.ValueType{i32}, []api.ValueType{i32}, nil,
+		opLocalGet(0), opI32Const('0'), []byte{0x6b}, // i32.sub
+		opI32Const(10), []byte{0x49}, // i32.lt_u
+	)
+	digits := tm.function([]api.ValueType{i32, i32}, []api.ValueType{i32}, nil,
+		[]byte{0x02, 0x40},                      // block
+		[]byte{0x03, 0x40},                      // loop
+		opLocalGet(1), []byte{0x45, 0x0d, 0x01}, // i32.eqz, br_if 1
+		opLocalGet(0), []byte{0x2d, 0x00, 0x00}, // i32.load8_u
+		opCall(isDigit), []byte{0x45}, // i32.eqz
+		[]byte{0x04, 0x40}, opI32Const(0), []byte{0x0f, 0x0b}, // if, return, end
+		opLocalGet(0), opI32Const(1), []byte{0x6a}, opLocalSet(0), // i32.add
+		opLocalGet(1), opI32Const(1), []byte{0x6b}, opLocalSet(1), // i32.sub
+		[]byte{0x0c, 0x00}, // br 0
+		[]byte{0x0b, 0x0b}, // end, end
+		opI32Const(1),
+	)
+	// the body goes at 16, the verdict at 0
+	run := tm.function(nil, nil, []api.ValueType{i32},
+		opI32Const(16), opI32Const(64<<10), opCall(readBody), opLocalSet(0),
+		opI32Const(0),
+		opI32Const(16), opLocalGet(0), opCall(digits),
+		opI32Const('0'), []byte{0x6a}, // i32.add
+		[]byte{0x3a, 0x00, 0x00}, // i32.store8
+		opI32Const(0), opI32Const(1), opCall(puts),
+	)
+	tm.exportFunc("digits", digits)
+	tm.exportFunc(runFnName, run)
+	return &tm
+}
+
+func TestFuelRealisticGuest(t *testing.T) {
+	ctx := context.Background()
+	wasmObj := digitsModule().bytes()
+	instrumented, err := instrumentFuel(wasmObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := wazero.NewRuntime(ctx)
+	t.Cleanup(func() { rt.Close(ctx) })
+	if _, err := newHostModuleBuilder(rt, hostABIs[hostABILegacy]).Instantiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := rt.Instantiate(ctx, instrumented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fuel := mod.ExportedGlobal(fuelGlobalExport).(api.MutableGlobal)
+	digits := mod.ExportedFunction("digits")
+	// used returns the fuel scanning the input used, and the verdict
+	used := func(input string) (int64, uint64) {
+		t.Helper()
+		if !mod.Memory().Write(16, []byte(input)) {
+			t.Fatal("input too large")
+		}
+		fuel.Set(1 << 20)
+		res, err := digits.Call(ctx, 16, uint64(len(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 1<<20 - int64(fuel.Get()), res[0]
+	}
+
+	empty, _ := used("")
+	ten, ok := used("0123456789")
+	twenty, _ := used("01234567890123456789")
+	if ok != 1 || twenty-ten != ten-empty {
+		t.Fatalf("got %d fuel for 0, 10 and 20 digits: the cost must grow linearly", []int64{empty, ten, twenty})
+	}
+	// the input after the first non digit is never read
+	early, ok := used("a123456789")
+	if other, _ := used("a"); ok != 0 || early != other || early >= ten {
+		t.Fatalf("an early exit used %d fuel, 10 digits %d", early, ten)
+	}
+	// the budget is an upper bound: each iteration started pays for the
+	// whole loop body up front, returning early or not. "1" starts one
+	// more iteration than "a", which is all it pays more for; the empty
+	// input runs a few instructions of its only iteration, but pays for
+	// all of them
+	digit, _ := used("1")
+	if loopBody := digit - early; empty < loopBody {
+		t.Fatalf("an empty input used %d fuel, the loop body costs %d", empty, loopBody)
+	}
+
+	// the charge is the same on every run: what was used is enough
+	if !mod.Memory().Write(16, []byte("0123456789")) {
+		t.Fatal("cannot write the input")
+	}
+	fuel.Set(uint64(ten))
+	if _, err := digits.Call(ctx, 16, 10); err != nil {
+		t.Fatalf("the fuel used before did not suffice: %v", err)
+	}
+	fuel.Set(uint64(ten - 1))
+	if _, err := digits.Call(ctx, 16, 10); err == nil {
+		t.Fatal("ran out of fuel without trapping")
+	}
+}
+
+func TestEngineFuelBudgetRealisticGuest(t *testing.T) {
+	we := newTestEngine(t, digitsModule().bytes(), moduleSettings{Capabilities: echoCapabilities, Fuel: 10_000})
+	if got := runOutput(t, we, "0123456789"); string(got) != "1" {
+		t.Fatalf("got %q, want 1", got)
+	}
+	// the budget is reset for each request
+	if got := runOutput(t, we, "012345678x"); string(got) != "0" {
+		t.Fatalf("got %q, want 0", got)
+	}
+	err := we.Run(context.Background(), "test", strings.NewReader(strings.Repeat("0", 10_000)), testRequestEnv, io.Discard)
+	if !errors.Is(err, errFuelExhausted) {
+		t.Fatalf("got error %v, want %v", err, errFuelExhausted)
+	}
+}
+
+func TestEngineFuelBudget(t *testing.T) {
+	var tm testModule
+	run := tm.function(nil, nil, nil, opLoopForever())
+	tm.exportFunc(runFnName, run)
+	we := newTestEngine(t, tm.bytes(), moduleSettings{Fuel: 100_000})
+
+	err := we.Run(context.Background(), "test", strings.NewReader(""), testRequestEnv, io.Discard)
+	if !errors.Is(err, errFuelExhausted) {
+		t.Fatalf("got error %v, want %v", err, errFuelExhausted)
+	}
+	var ge *guestError
+	if !errors.As(err, &ge) || ge.Kind != errKindResourceLimit {
+		t.Fatalf("got error %v, want a %s one", err, errKindResourceLimit)
+	}
+}
@@ -1,11 +1,13 @@
 module github.com/ffromani/httpwasm-go/hostfunctions
 
-go 1.21
+go 1.24
 
-require github.com/tetratelabs/wazero v1.5.0
+require (
+	github.com/tetratelabs/wazero v1.5.0
+	github.com/tidwall/gjson v1.17.0
+)
 
 require (
-	github.com/tidwall/gjson v1.17.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 )
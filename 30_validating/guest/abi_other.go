@@ -0,0 +1,34 @@
+//go:build !wasm
+
+package guest
+
+// outside of wasm there is no host: this just lets the package build
+// and be vetted along the host code
+
+func readBody() []byte {
+	panic("guest: not running in a wasm host")
+}
+
+func readEnv() []byte {
+	panic("guest: not running in a wasm host")
+}
+
+func readConfig() []byte {
+	panic("guest: not running in a wasm host")
+}
+
+func lookupJSON(path string) (uint32, []byte) {
+	panic("guest: not running in a wasm host")
+}
+
+func writeStdout(p []byte) {
+	panic("guest: not running in a wasm host")
+}
+
+func writeStdoutString(s string) {
+	panic("guest: not running in a wasm host")
+}
+
+func writeStderr(p []byte) {
+	panic("guest: not running in a wasm host")
+}
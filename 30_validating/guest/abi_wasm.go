@@ -0,0 +1,97 @@
+//go:build wasm
+
+package guest
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// most requests and values fit, so most reads need a single host call
+const (
+	initialBufferSize = 4096
+	initialValueSize  = 256
+)
+
+//go:wasmimport httpwasm ireadbody
+func ireadbody(bufPtr, bufCap uint32) uint32
+
+//go:wasmimport httpwasm ireadenv
+func ireadenv(bufPtr, bufCap uint32) uint32
+
+//go:wasmimport httpwasm ireadconfig
+func ireadconfig(bufPtr, bufCap uint32) uint32
+
+//go:wasmimport httpwasm ijsonget
+func ijsonget(pathPtr, pathLen, bufPtr, bufCap uint32) uint64
+
+//go:wasmimport httpwasm oputs
+func oputs(bufPtr, bufLen uint32)
+
+//go:wasmimport httpwasm eputs
+func eputs(bufPtr, bufLen uint32)
+
+func readBody() []byte {
+	return readBuffer(ireadbody)
+}
+
+func readEnv() []byte {
+	return readBuffer(ireadenv)
+}
+
+func readConfig() []byte {
+	return readBuffer(ireadconfig)
+}
+
+// lookupJSON returns the type and the value at the path, calling the
+// host again with a larger buffer if the first one was too small.
+func lookupJSON(path string) (uint32, []byte) {
+	buf := make([]byte, initialValueSize)
+	for {
+		ret := ijsonget(uint32(uintptr(unsafe.Pointer(unsafe.StringData(path)))), uint32(len(path)),
+			uint32(uintptr(unsafe.Pointer(unsafe.SliceData(buf)))), uint32(len(buf)))
+		runtime.KeepAlive(path)
+		jsonType, n := uint32(ret>>32), uint32(ret)
+		if int(n) <= len(buf) {
+			return jsonType, buf[:n]
+		}
+		buf = make([]byte, n)
+	}
+}
+
+// readBuffer calls the host function, which returns the size of the
+// data, again with a larger buffer if the first one was too small.
+func readBuffer(read func(bufPtr, bufCap uint32) uint32) []byte {
+	buf := make([]byte, initialBufferSize)
+	for {
+		n := read(uint32(uintptr(unsafe.Pointer(unsafe.SliceData(buf)))), uint32(len(buf)))
+		if int(n) <= len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, n)
+	}
+}
+
+func writeStdout(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	oputs(uint32(uintptr(unsafe.Pointer(unsafe.SliceData(p)))), uint32(len(p)))
+	runtime.KeepAlive(p)
+}
+
+func writeStdoutString(s string) {
+	if len(s) == 0 {
+		return
+	}
+	oputs(uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s)))
+	runtime.KeepAlive(s)
+}
+
+func writeStderr(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	eputs(uint32(uintptr(unsafe.Pointer(unsafe.SliceData(p)))), uint32(len(p)))
+	runtime.KeepAlive(p)
+}
@@ -0,0 +1,27 @@
+// Package guest is the guest side of the httpwasm host interface: it
+// wraps the host functions with idiomatic types, so modules only need to
+// provide a handler:
+//
+//	func init() {
+//		guest.Handle(func(w guest.ResponseWriter, r *guest.Request) {
+//			body, _ := io.ReadAll(r.Body)
+//			w.Write(body)
+//		})
+//	}
+//
+//	func main() {}
+//
+// The package exports the "run" entrypoint. The data comes from the host
+// in buffers the package provides: modules need no allocator exports.
+// Handlers must be registered in init: reactors never run main.
+// Besides "io", modules need the "body" and "env" capabilities, and
+// "config" and "json" if they use Config and the JSON lookups.
+//
+// Modules build with TinyGo:
+//
+//	tinygo build -o guest.wasm -target=wasi -scheduler=none guest.go
+//
+// or with Go 1.24 and later:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o guest.wasm guest.go
+package guest
@@ -0,0 +1,8 @@
+//go:build wasm && !tinygo
+
+package guest
+
+//go:wasmexport run
+func run() {
+	serve()
+}
@@ -0,0 +1,8 @@
+//go:build tinygo
+
+package guest
+
+//go:export run
+func run() {
+	serve()
+}
@@ -0,0 +1,152 @@
+package guest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const (
+	headerEnvPrefix = "HTTP_HEADER_"
+)
+
+// Header holds the request headers. The values of repeated headers are
+// comma-separated.
+type Header map[string]string
+
+// Get returns the value of the header, ignoring the case of the name.
+func (h Header) Get(name string) string {
+	if value, ok := h[name]; ok {
+		return value
+	}
+	for key, value := range h {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Request is the request the module is serving.
+type Request struct {
+	Method     string
+	Path       string
+	Host       string
+	Query      url.Values
+	RemoteAddr string
+	Header     Header
+	// Env is the request environment as the host provides it; the
+	// module environment, from its settings, is in os.Environ.
+	Env map[string]string
+	// Body is read from the host on first use.
+	Body io.Reader
+}
+
+// ResponseWriter writes the response body.
+type ResponseWriter interface {
+	io.Writer
+	io.StringWriter
+}
+
+// HandlerFunc serves a request.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+var handler HandlerFunc
+
+// Handle registers the function serving the requests.
+func Handle(h HandlerFunc) {
+	handler = h
+}
+
+// Config returns the module configuration from the module settings, if
+// any. It can be called while serving a request, and during the module
+// initialization, from the init functions.
+func Config() []byte {
+	return readConfig()
+}
+
+// Stderr writes to the module stderr, which the host logs.
+var Stderr io.Writer = stderrWriter{}
+
+// Logf writes a line to the module stderr.
+func Logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	io.WriteString(Stderr, msg)
+}
+
+// serve runs the registered handler on the current request.
+func serve() {
+	if handler == nil {
+		Logf("guest: no handler registered")
+		return
+	}
+	handler(stdoutWriter{}, newRequest())
+}
+
+func newRequest() *Request {
+	env := parseEnv(readEnv())
+	req := Request{
+		Method:     env["HTTP_METHOD"],
+		Path:       env["HTTP_PATH"],
+		Host:       env["HTTP_HOST"],
+		RemoteAddr: env["REMOTE_ADDR"],
+		Header:     make(Header),
+		Env:        env,
+		Body:       &body{},
+	}
+	req.Query, _ = url.ParseQuery(env["HTTP_QUERY"])
+	for key, value := range env {
+		if name, ok := strings.CutPrefix(key, headerEnvPrefix); ok {
+			req.Header[name] = value
+		}
+	}
+	return &req
+}
+
+// parseEnv decodes the NUL-terminated "KEY=VALUE" entries.
+func parseEnv(data []byte) map[string]string {
+	env := make(map[string]string)
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		key, value, ok := bytes.Cut(entry, []byte("="))
+		if ok {
+			env[string(key)] = string(value)
+		}
+	}
+	return env
+}
+
+// body fetches the request body from the host the first time it's read.
+type body struct {
+	rd *bytes.Reader
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.rd == nil {
+		b.rd = bytes.NewReader(readBody())
+	}
+	return b.rd.Read(p)
+}
+
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	writeStdout(p)
+	return len(p), nil
+}
+
+func (stdoutWriter) WriteString(s string) (int, error) {
+	writeStdoutString(s)
+	return len(s), nil
+}
+
+type stderrWriter struct{}
+
+func (stderrWriter) Write(p []byte) (int, error) {
+	writeStderr(p)
+	return len(p), nil
+}
@@ -0,0 +1,81 @@
+package guest
+
+import "strconv"
+
+// JSONType is the type of a JSON value.
+type JSONType uint32
+
+// the values match the host ones
+const (
+	JSONMissing JSONType = iota
+	JSONNull
+	JSONBool
+	JSONNumber
+	JSONString
+	JSONObjectOrArray
+)
+
+func (jt JSONType) String() string {
+	switch jt {
+	case JSONMissing:
+		return "missing"
+	case JSONNull:
+		return "null"
+	case JSONBool:
+		return "boolean"
+	case JSONNumber:
+		return "number"
+	case JSONString:
+		return "string"
+	case JSONObjectOrArray:
+		return "json"
+	}
+	return "unknown"
+}
+
+// JSONValue is a value looked up in the request body.
+type JSONValue struct {
+	Type JSONType
+	// the unescaped text for strings, the JSON text otherwise
+	Raw string
+}
+
+func (jv JSONValue) Exists() bool {
+	return jv.Type != JSONMissing
+}
+
+// String returns the text of the value; empty if missing or null.
+func (jv JSONValue) String() string {
+	if jv.Type == JSONNull {
+		return ""
+	}
+	return jv.Raw
+}
+
+// Float returns the value of numbers, false for anything else.
+func (jv JSONValue) Float() (float64, bool) {
+	if jv.Type != JSONNumber {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(jv.Raw, 64)
+	return f, err == nil
+}
+
+// Bool returns the value of booleans, false for anything else.
+func (jv JSONValue) Bool() (bool, bool) {
+	if jv.Type != JSONBool {
+		return false, false
+	}
+	return jv.Raw == "true", true
+}
+
+// JSON looks up the gjson path (https://github.com/tidwall/gjson) in the
+// request body. The lookup runs on the host: the body is never copied
+// in the module, unless read.
+func (r *Request) JSON(path string) JSONValue {
+	jsonType, value := lookupJSON(path)
+	return JSONValue{
+		Type: JSONType(jsonType),
+		Raw:  string(value),
+	}
+}
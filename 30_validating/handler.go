@@ -2,47 +2,100 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
+const (
+	requestIDHeader = "X-Request-Id"
+	requestIDMaxLen = 64
+	headerEnvPrefix = "HTTP_HEADER_"
+)
+
 type wasmHandler struct {
-	engine *wasmEngine
-	name   string
+	slot *moduleSlot
+	name string
 }
 
 func (wh *wasmHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var ts time.Time
-	log.Printf("start")
-	ctx := context.Background()
+	reqID := requestID(r)
+	log.Printf("start (request %s)", reqID)
+	w.Header().Set(requestIDHeader, reqID)
+	r = r.WithContext(withRequestID(r.Context(), reqID))
+	ctx := withRequestID(context.Background(), reqID)
 
 	ts = time.Now()
-	stdout, stderr, err := wh.engine.Run(ctx, wh.name, r.Body, wh.makeEnviron(r))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := errEngineClosed
+	if dep := wh.slot.Acquire(); dep != nil {
+		err = dep.engine.Run(ctx, wh.name, r.Body, wh.makeEnviron(r), w)
+		wh.slot.Release(ctx, dep)
+	}
+	log.Printf("request served in %v", time.Since(ts))
+	if errors.Is(err, errResponseWrite) {
+		// the response is on its way already: too late to report anything
+		log.Printf("module %q: %v", wh.name, err)
 		return
 	}
-
-	if stderr != "" {
-		log.Printf("module stderr: [%s]", stderr)
+	if err != nil {
+		wh.slot.opts.problems.WriteError(w, r, wh.name, err)
+		return
 	}
-	log.Printf("module stdout: [%s]", stdout)
-
-	ts = time.Now()
-	fmt.Fprint(w, stdout)
-	log.Printf("response sent in %v", time.Since(ts))
 
 	log.Printf("done!")
 }
 
+// makeEnviron describes the request to the guest. The headers are
+// added as HTTP_HEADER_<canonical name>, the values comma-separated.
 func (wh *wasmHandler) makeEnviron(r *http.Request) map[string]string {
-	return map[string]string{
+	env := map[string]string{
 		"HTTP_PATH":   r.URL.Path,
 		"HTTP_METHOD": r.Method,
 		"HTTP_HOST":   r.Host,
 		"HTTP_QUERY":  r.URL.Query().Encode(),
 		"REMOTE_ADDR": r.RemoteAddr,
 	}
+	for name, values := range r.Header {
+		env[headerEnvPrefix+name] = strings.Join(values, ", ")
+	}
+	return env
+}
+
+// requestID returns the ID the client sent, if usable as a file name,
+// or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); isSafeRequestID(id) {
+		return id
+	}
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+func isSafeRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLen || id[0] == '.' {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
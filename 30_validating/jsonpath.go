@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tidwall/gjson"
+)
+
+// the types of the values ijsonget returns
+const (
+	jsonTypeMissing = iota
+	jsonTypeNull
+	jsonTypeBool
+	jsonTypeNumber
+	jsonTypeString
+	jsonTypeJSON // object or array
+)
+
+// ijsonget looks up the gjson path in the request body, so guests can
+// extract fields without getting, nor parsing, the whole body. The value
+// is written in the buffer the guest provides, like ireadbody does: the
+// unescaped text for strings, the JSON text otherwise. Returns the type
+// of the value in the upper 32 bits, the size of the value in the lower.
+func ijsonget(ctx context.Context, mod api.Module, pathPtr, pathLen, bufPtr, bufCap uint32) uint64 {
+	cdata := getCallData(ctx)
+	cdata.grants.Enforce("ijsonget")
+
+	path, ok := mod.Memory().Read(pathPtr, pathLen)
+	if !ok {
+		panic(fmt.Errorf("%w: ijsonget: path of %d bytes at %#x out of guest memory", errHostFunction, pathLen, pathPtr))
+	}
+	res := gjson.GetBytes(cdata.body, string(path))
+	jsonType, value := jsonTypeOf(res), res.Raw
+	if jsonType == jsonTypeString {
+		value = res.Str
+	}
+	size := putGuestBuffer(mod, "ijsonget", bufPtr, bufCap, []byte(value))
+	return uint64(jsonType)<<32 | uint64(size)
+}
+
+func jsonTypeOf(res gjson.Result) uint32 {
+	if !res.Exists() {
+		return jsonTypeMissing
+	}
+	switch res.Type {
+	case gjson.Null:
+		return jsonTypeNull
+	case gjson.False, gjson.True:
+		return jsonTypeBool
+	case gjson.Number:
+		return jsonTypeNumber
+	case gjson.String:
+		return jsonTypeString
+	}
+	return jsonTypeJSON
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// jsonGetModule writes what ijsonget returns for the path, then its buffer.
+func jsonGetModule(path string, bufCap int32) []byte {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	var tm testModule
+	jsonGet := tm.importFunc(hostModuleName, "ijsonget", []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i64})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	tm.dataAt(1024, []byte(path))
+	run := tm.function(nil, nil, nil,
+		opI32Const(0),
+		opI32Const(1024), opI32Const(int32(len(path))), opI32Const(8), opI32Const(bufCap), opCall(jsonGet),
+		[]byte{0x37, 0x03, 0x00}, // i64.store
+		opI32Const(0), opI32Const(8+bufCap), opCall(puts),
+	)
+	tm.exportFunc(runFnName, run)
+	return tm.bytes()
+}
+
+func TestJSONGet(t *testing.T) {
+	const body = `{"name": {"first": "John"}, "age": 42, "tags": ["a", "b"], "ok": true, "none": null, "nul": "a\u0000b"}`
+	tests := []struct {
+		name     string
+		body     string
+		path     string
+		bufCap   int32
+		wantType uint32
+		want     string
+	}{
+		{name: "string", path: "name.first", bufCap: 4, wantType: jsonTypeString, want: "John"},
+		{name: "number", path: "age", bufCap: 2, wantType: jsonTypeNumber, want: "42"},
+		{name: "bool", path: "ok", bufCap: 4, wantType: jsonTypeBool, want: "true"},
+		{name: "null", path: "none", bufCap: 4, wantType: jsonTypeNull, want: "null"},
+		{name: "array", path: "tags", bufCap: 10, wantType: jsonTypeJSON, want: `["a", "b"]`},
+		{name: "object", path: "name", bufCap: 17, wantType: jsonTypeJSON, want: `{"first": "John"}`},
+		{name: "array element", path: "tags.1", bufCap: 1, wantType: jsonTypeString, want: "b"},
+		// strings are unescaped
+		{name: "embedded NUL", path: "nul", bufCap: 3, wantType: jsonTypeString, want: "a\x00b"},
+		{name: "missing", path: "name.last", bufCap: 4, wantType: jsonTypeMissing},
+		{name: "empty path", path: "", bufCap: 4, wantType: jsonTypeMissing},
+		{name: "not JSON", body: "{", path: "name", bufCap: 4, wantType: jsonTypeMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonBody := body
+			if tt.body != "" {
+				jsonBody = tt.body
+			}
+			we := newTestEngine(t, jsonGetModule(tt.path, tt.bufCap), moduleSettings{Capabilities: []string{"io", "json"}})
+			out := runOutput(t, we, jsonBody)
+			ret := binary.LittleEndian.Uint64(out)
+			if typ, size := uint32(ret>>32), uint32(ret); typ != tt.wantType || int(size) != len(tt.want) {
+				t.Fatalf("got type %d, size %d, want type %d, size %d", typ, size, tt.wantType, len(tt.want))
+			}
+			if got := string(out[8 : 8+len(tt.want)]); got != tt.want {
+				t.Fatalf("got value %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONGetBufferTooSmall(t *testing.T) {
+	we := newTestEngine(t, jsonGetModule("name.first", 2), moduleSettings{Capabilities: []string{"io", "json"}})
+	out := runOutput(t, we, `{"name": {"first": "John"}}`)
+	// the guest must call again, with a buffer of the size returned
+	if ret := binary.LittleEndian.Uint64(out); ret != jsonTypeString<<32|4 {
+		t.Fatalf("got %#x, want the type and the whole size", ret)
+	}
+	if got := string(out[8:]); got != "Jo" {
+		t.Fatalf("got value %q, want the part fitting the buffer", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	overflowAbort    = "abort"
+	overflowTruncate = "truncate"
+
+	defaultMaxBody   = 1 << 20  // 1 MiB
+	defaultMaxStdout = 1 << 20  // 1 MiB
+	defaultMaxStderr = 64 << 10 // 64 KiB
+	defaultTimeout   = 30 * time.Second
+)
+
+var (
+	errBodyTooLarge   = errors.New("request body too large")
+	errBodyRead       = errors.New("cannot read the request body")
+	errOutputTooLarge = errors.New("guest output too large")
+)
+
+// sizeLimit caps a data stream. What happens past the cap depends on the
+// overflow policy: "abort" fails the request, "truncate" drops the excess.
+type sizeLimit struct {
+	Max      int64  `json:"max,omitempty"`
+	Overflow string `json:"overflow,omitempty"`
+}
+
+// limitsSettings caps the data flowing in and out of the guest, and
+// how long it runs for each request.
+// Unset fields get the defaults: nothing is ever unbounded.
+type limitsSettings struct {
+	Body   sizeLimit `json:"body,omitempty"`
+	Stdout sizeLimit `json:"stdout,omitempty"`
+	Stderr sizeLimit `json:"stderr,omitempty"`
+	// Timeout is a Go duration, like "500ms". Past it, the guest is
+	// stopped and the request fails.
+	Timeout string `json:"timeout,omitempty"`
+
+	// Timeout, parsed
+	timeout time.Duration
+}
+
+// withDefaults fills the unset fields and validates the policies.
+func (ls limitsSettings) withDefaults() (limitsSettings, error) {
+	var err error
+	ls.timeout = defaultTimeout
+	if ls.Timeout != "" {
+		ls.timeout, err = time.ParseDuration(ls.Timeout)
+		if err != nil {
+			return ls, fmt.Errorf("timeout: %w", err)
+		}
+		if ls.timeout <= 0 {
+			return ls, fmt.Errorf("timeout: must be positive, got %v", ls.timeout)
+		}
+	}
+	if ls.Body, err = ls.Body.withDefaults("body", defaultMaxBody, overflowAbort); err != nil {
+		return ls, err
+	}
+	if ls.Stdout, err = ls.Stdout.withDefaults("stdout", defaultMaxStdout, overflowAbort); err != nil {
+		return ls, err
+	}
+	if ls.Stderr, err = ls.Stderr.withDefaults("stderr", defaultMaxStderr, overflowTruncate); err != nil {
+		return ls, err
+	}
+	return ls, nil
+}
+
+func (sl sizeLimit) withDefaults(what string, max int64, overflow string) (sizeLimit, error) {
+	if sl.Max == 0 {
+		sl.Max = max
+	}
+	if sl.Overflow == "" {
+		sl.Overflow = overflow
+	}
+	if sl.Max < 0 {
+		return sl, fmt.Errorf("%s limit: negative max size %d", what, sl.Max)
+	}
+	if sl.Overflow != overflowAbort && sl.Overflow != overflowTruncate {
+		return sl, fmt.Errorf("%s limit: unknown overflow policy %q", what, sl.Overflow)
+	}
+	return sl, nil
+}
+
+// readLimited reads all the data in buf, applying the limit.
+func readLimited(buf *bytes.Buffer, r io.Reader, limit sizeLimit) (bool, error) {
+	if _, err := buf.ReadFrom(io.LimitReader(r, limit.Max+1)); err != nil {
+		return false, fmt.Errorf("%w: %w", errBodyRead, err)
+	}
+	if int64(buf.Len()) <= limit.Max {
+		return false, nil
+	}
+	if limit.Overflow == overflowAbort {
+		return false, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, limit.Max)
+	}
+	buf.Truncate(int(limit.Max))
+	return true, nil
+}
+
+// limitedBuffer is a bytes.Buffer which can't grow past the limit.
+// When the policy is abort, overflowing writes nothing and fails with
+// errOutputTooLarge: the host functions writing it trap the guest.
+type limitedBuffer struct {
+	bytes.Buffer
+	name      string
+	limit     sizeLimit
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(data []byte) (int, error) {
+	room := lb.limit.Max - int64(lb.Len())
+	if int64(len(data)) <= room {
+		return lb.Buffer.Write(data)
+	}
+	if lb.limit.Overflow == overflowAbort {
+		return 0, fmt.Errorf("%w: %s exceeds %d bytes", errOutputTooLarge, lb.name, lb.limit.Max)
+	}
+	lb.truncated = true
+	lb.Buffer.Write(data[:room])
+	return len(data), nil // pretend all went well, the guest can't do any better
+}
+
+func (lb *limitedBuffer) Reset() {
+	lb.Buffer.Reset()
+	lb.truncated = false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          io.Reader
+		limit         sizeLimit
+		want          string
+		wantTruncated bool
+		wantErr       error
+	}{
+		{name: "under", body: strings.NewReader("abc"), limit: sizeLimit{Max: 4, Overflow: overflowAbort}, want: "abc"},
+		{name: "at the limit", body: strings.NewReader("abcd"), limit: sizeLimit{Max: 4, Overflow: overflowAbort}, want: "abcd"},
+		{name: "over, abort", body: strings.NewReader("abcde"), limit: sizeLimit{Max: 4, Overflow: overflowAbort}, wantErr: errBodyTooLarge},
+		{name: "over, truncate", body: strings.NewReader("abcde"), limit: sizeLimit{Max: 4, Overflow: overflowTruncate}, want: "abcd", wantTruncated: true},
+		{name: "read error", body: iotest.ErrReader(io.ErrUnexpectedEOF), limit: sizeLimit{Max: 4, Overflow: overflowAbort}, wantErr: errBodyRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			truncated, err := readLimited(&buf, tt.body, tt.limit)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want || truncated != tt.wantTruncated {
+				t.Fatalf("got %q, truncated %v, want %q, truncated %v", buf.String(), truncated, tt.want, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		overflow      string
+		writes        []string
+		want          string
+		wantTruncated bool
+		wantErr       error
+	}{
+		{name: "under", overflow: overflowAbort, writes: []string{"ab", "cd"}, want: "abcd"},
+		{name: "over, abort", overflow: overflowAbort, writes: []string{"ab", "cde"}, want: "ab", wantErr: errOutputTooLarge},
+		{name: "over, truncate", overflow: overflowTruncate, writes: []string{"ab", "cde", "f"}, want: "abcd", wantTruncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := limitedBuffer{name: "stdout", limit: sizeLimit{Max: 4, Overflow: tt.overflow}}
+			var err error
+			for _, data := range tt.writes {
+				var n int
+				n, err = lb.Write([]byte(data))
+				if err != nil {
+					if n != 0 {
+						t.Fatalf("failed write: got %d bytes written", n)
+					}
+					break
+				}
+				if n != len(data) {
+					t.Fatalf("got %d bytes written, want %d", n, len(data))
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if lb.String() != tt.want || lb.truncated != tt.wantTruncated {
+				t.Fatalf("got %q, truncated %v, want %q, truncated %v", lb.String(), lb.truncated, tt.want, tt.wantTruncated)
+			}
+			lb.Reset()
+			if lb.Len() != 0 || lb.truncated {
+				t.Fatal("reset kept the state")
+			}
+		})
+	}
+}
+
+func TestHandlerBodyLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow string
+		wantCode int
+		wantBody string
+	}{
+		{name: "abort", overflow: overflowAbort, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "truncate", overflow: overflowTruncate, wantCode: http.StatusOK, wantBody: "abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := newModuleRegistry(nil)
+			t.Cleanup(func() { registry.Close(ctx) })
+			slot, err := registry.Register(ctx, "echo", echoModule().bytes(), moduleSettings{
+				Capabilities: echoCapabilities,
+				Limits:       limitsSettings{Body: sizeLimit{Max: 4, Overflow: tt.overflow}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wh := wasmHandler{slot: slot, name: "echo"}
+
+			rec := httptest.NewRecorder()
+			wh.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("abcdef")))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode == http.StatusOK {
+				if rec.Body.String() != tt.wantBody {
+					t.Fatalf("got body %q, want %q", rec.Body, tt.wantBody)
+				}
+				return
+			}
+			var pb problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &pb); err != nil {
+				t.Fatal(err)
+			}
+			if pb.Type != problemTypePrefix+errKindBodyTooLarge {
+				t.Fatalf("got problem %+v", pb)
+			}
+		})
+	}
+}
+
+func TestEngineOutputLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow string
+		want     string
+		wantKind string
+	}{
+		{name: "abort", overflow: overflowAbort, wantKind: errKindResourceLimit},
+		{name: "truncate", overflow: overflowTruncate, want: "abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := newTestEngine(t, echoModule().bytes(), moduleSettings{
+				Capabilities: echoCapabilities,
+				Limits:       limitsSettings{Stdout: sizeLimit{Max: 4, Overflow: tt.overflow}},
+			})
+			var out bytes.Buffer
+			err := we.Run(context.Background(), "test", strings.NewReader("abcdef"), testRequestEnv, &out)
+			if tt.wantKind != "" {
+				if ge := classifyError(err); ge.Kind != tt.wantKind {
+					t.Fatalf("got error %v, want a %s one", err, tt.wantKind)
+				}
+				if out.Len() != 0 {
+					t.Fatalf("got output %q from a failed run", out.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Fatalf("got output %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
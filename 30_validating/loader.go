@@ -2,10 +2,10 @@ package main
 
 import (
 	"embed"
+	"errors"
 	"io"
 	"io/fs"
 	"log"
-	"os"
 	"time"
 )
 
@@ -13,28 +13,40 @@ import (
 var builtinModules embed.FS
 
 type wasmLoader struct {
+	bundle  fs.FS
+	store   fs.FS
 	builtin fs.FS
 	local   fs.FS
+	remote  fs.FS
 }
 
+// LoadModule looks up the module in all the configured sources, in order
+// of precedence, and returns the first one found. The name can also be
+// a module store reference (see moduleStore).
 func (wl *wasmLoader) LoadModule(name string) (data []byte, err error) {
-	var origin string
-
 	modName := name + ".wasm"
 
-	origin = "local"
-	data, err = tryToReadAll(wl.local, modName, origin)
-
-	if err == nil {
-		return data, nil
-	}
-	if err != nil && !os.IsNotExist(err) {
-		return nil, err // non recoverable
+	sources := []struct {
+		origin string
+		fsys   fs.FS
+	}{
+		{origin: "bundle", fsys: wl.bundle},
+		{origin: "store", fsys: wl.store},
+		{origin: "local", fsys: wl.local},
+		{origin: "remote", fsys: wl.remote},
+		{origin: "builtin", fsys: wl.builtin},
 	}
 
-	origin = "builtin"
-	data, err = tryToReadAll(wl.builtin, modName, origin)
-	return data, err
+	for _, src := range sources {
+		data, err = tryToReadAll(src.fsys, modName, src.origin)
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err // non recoverable
+		}
+	}
+	return nil, err
 }
 
 func tryToReadAll(fsys fs.FS, name, origin string) (data []byte, err error) {
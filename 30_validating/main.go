@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/fs"
@@ -11,48 +13,160 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		os.Exit(storeMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "meta" {
+		os.Exit(metaMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "preinit" {
+		os.Exit(preinitMain(os.Args[2:]))
+	}
+
 	var handler string
 	var modulesPath string
+	var bundlePath string
+	var storePath string
+	var manifestPath string
+	var remoteURL string
+	var remoteCache string
+	var remoteMaxSize int64
+	var adminAddr string
+	var coredumpDir string
+	var coredumpRetention int
 	var port int
-	flag.StringVar(&handler, "handler", "validate", "wasm module to serve requests (<name>.wasm)")
+	flag.StringVar(&handler, "handler", "validate", "wasm module to serve requests (<name>.wasm, or a store reference)")
 	flag.StringVar(&modulesPath, "modules", "modules", "external modules to load (use empty to disable)")
+	flag.StringVar(&bundlePath, "bundle", "", "module bundle to load (.tar.gz or .zip, use empty to disable)")
+	flag.StringVar(&storePath, "store", "", "module store directory (use empty to disable)")
+	flag.StringVar(&manifestPath, "manifest", "", "manifest describing modules and routes (overrides the bundle manifest)")
+	flag.StringVar(&remoteURL, "remote", "", "URL template to fetch modules from, {name} is replaced by the module name (use empty to disable)")
+	flag.StringVar(&remoteCache, "remote-cache", "cache", "directory to cache remote modules (use empty to disable)")
+	flag.Int64Var(&remoteMaxSize, "remote-max-size", remoteDefaultMaxSize, "max size in bytes of a remote module")
+	flag.StringVar(&adminAddr, "admin-addr", "", "loopback address to serve the admin API on, e.g. 127.0.0.1:8081 (use empty to disable)")
+	flag.StringVar(&coredumpDir, "coredump-dir", "", "directory to write guest core dumps to on traps (use empty to disable)")
+	flag.IntVar(&coredumpRetention, "coredump-retention", coredumpDefaultRetention, "max number of core dumps to keep")
 	flag.IntVar(&port, "port", 8080, "port to listen to")
 	flag.Parse()
 
+	if adminAddr != "" {
+		if err := checkAdminAddr(adminAddr); err != nil {
+			log.Fatalf("error in the admin API address: %v", err)
+		}
+	}
+
 	var localModules fs.FS
 	if modulesPath != "" {
 		localModules = os.DirFS(modulesPath)
 	}
 
+	var store *moduleStore
+	var storeModules fs.FS
+	if storePath != "" {
+		store = newModuleStore(storePath)
+		storeModules = store
+	}
+
+	var remoteModules fs.FS
+	if remoteURL != "" {
+		rf := newRemoteFS(remoteURL, remoteCache)
+		rf.maxSize = remoteMaxSize
+		remoteModules = rf
+	}
+
+	var mf *manifest
+	var bundleModules fs.FS
+	if bundlePath != "" {
+		bf, err := openBundle(bundlePath)
+		if err != nil {
+			log.Fatalf("error opening bundle %q: %v", bundlePath, err)
+		}
+		bundleModules = bf
+
+		mf, err = readManifestFS(bf)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("error reading manifest from bundle %q: %v", bundlePath, err)
+		}
+	}
+	if manifestPath != "" {
+		var err error
+		mf, err = readManifestFile(manifestPath)
+		if err != nil {
+			log.Fatalf("error reading manifest %q: %v", manifestPath, err)
+		}
+	}
+	if err := mf.resolveDigests(store); err != nil {
+		log.Fatalf("error resolving manifest references: %v", err)
+	}
+
 	wl := wasmLoader{
+		bundle:  bundleModules,
+		store:   storeModules,
 		builtin: builtinModules,
 		local:   localModules,
+		remote:  remoteModules,
 	}
 
-	// loadModule does its own logging
-	wasmObj, err := wl.LoadModule(handler)
-	if err != nil {
-		log.Fatalf("error loading %q: %v", handler, err)
+	routes := []manifestRoute{
+		{Path: "/", Module: handler},
+	}
+	if mf != nil && len(mf.Routes) > 0 {
+		routes = mf.Routes
 	}
 
 	ctx := context.Background()
 
-	we, err := newWasmEngine(ctx, wasmObj)
-	if err != nil {
-		log.Fatalf("error creating engine: %v", err)
+	registry := newModuleRegistry(bundleModules)
+	defer registry.Close(ctx)
+	if coredumpDir != "" {
+		cw, err := newCoredumpWriter(coredumpDir, coredumpRetention)
+		if err != nil {
+			log.Fatalf("error setting up core dumps in %q: %v", coredumpDir, err)
+		}
+		registry.coredumps = cw
 	}
-	defer we.Close(ctx)
 
-	wh := wasmHandler{
-		engine: we,
-		name:   handler,
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		slot, ok := registry.Slot(route.Module)
+		if !ok {
+			// loadModule does its own logging
+			wasmObj, err := wl.LoadModule(route.Module)
+			if err != nil {
+				log.Fatalf("error loading %q: %v", route.Module, err)
+			}
+
+			slot, err = registry.Register(ctx, route.Module, wasmObj, mf.Settings(route.Module))
+			if err != nil {
+				log.Fatalf("error creating engine for %q: %v", route.Module, err)
+			}
+		}
+
+		wh := wasmHandler{
+			slot: slot,
+			name: route.Module,
+		}
+		log.Printf("serving %q with module %q", route.Path, route.Module)
+		mux.HandleFunc(route.Path, wh.ServeHTTP)
+	}
+
+	if adminAddr != "" {
+		ah := adminHandler{
+			registry:  registry,
+			maxUpload: adminDefaultMaxUpload,
+		}
+		adminMux := http.NewServeMux()
+		adminMux.Handle(adminModulesPrefix, &ah)
+		adminMux.Handle("/debug/vars", expvar.Handler())
+		log.Printf("starting admin API, listen on [%s]", adminAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(adminAddr, adminMux))
+		}()
 	}
 
 	addr := fmt.Sprintf(":%d", port)
 	log.Printf("starting, listen on [%s]", addr)
 	defer log.Printf("done!")
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", wh.ServeHTTP)
 	log.Fatal(http.ListenAndServe(addr, mux))
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+const (
+	manifestName = "manifest.json"
+)
+
+// manifest describes a deployment: which modules to load, which paths
+// they serve and how each of them is configured.
+// Modules are looked up as <name>.wasm through the usual loader.
+type manifest struct {
+	Modules []manifestModule `json:"modules"`
+	Routes  []manifestRoute  `json:"routes"`
+
+	// the module names of the digest references, see resolveDigests
+	digestNames map[string]string
+}
+
+type manifestModule struct {
+	Name     string         `json:"name"`
+	Settings moduleSettings `json:"settings"`
+}
+
+type manifestRoute struct {
+	Path   string `json:"path"`
+	Module string `json:"module"`
+}
+
+// moduleSettings holds the per-module configuration. The zero value is
+// the configuration every module gets when there is no manifest.
+type moduleSettings struct {
+	// Env is the static environment the module is instantiated with.
+	Env map[string]string `json:"env,omitempty"`
+	// Args are the static command line arguments, starting with
+	// the program name, the module is instantiated with.
+	Args []string `json:"args,omitempty"`
+	// Mounts are the directories the module can access.
+	Mounts []mountSettings `json:"mounts,omitempty"`
+	// Stdin is the stdin policy: "none" (default) or "inherit".
+	Stdin string `json:"stdin,omitempty"`
+	// Deterministic, if set, pins clocks and random source. Never
+	// set it in production.
+	Deterministic *deterministicSettings `json:"deterministic,omitempty"`
+	// Fuel is the CPU budget of each request, in executed instructions.
+	// The instructions are estimated from above, early exits from loops
+	// and functions being charged as full iterations and calls, so the
+	// budget needs some headroom. Zero, the default, means unmetered.
+	Fuel int64 `json:"fuel,omitempty"`
+	// Limits caps the request body and the guest output sizes.
+	Limits limitsSettings `json:"limits,omitempty"`
+	// Recycle controls when the guest instance is replaced by a fresh one.
+	Recycle recycleSettings `json:"recycle,omitempty"`
+	// Snapshot restores the guest memory and globals to their state
+	// after initialization at the end of each request, so nothing leaks
+	// from one request to the next.
+	Snapshot bool `json:"snapshot,omitempty"`
+	// Errors controls how guest failures are reported to clients.
+	Errors errorSettings `json:"errors,omitempty"`
+	// Capabilities lists the host functions, or groups of, the module
+	// may use. If omitted, the module gets defaultCapabilities.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Config is passed as is to the module, which reads it with
+	// ireadconfig; its meaning is up to the module.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+func readManifestFile(path string) (*manifest, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return decodeManifest(src)
+}
+
+func readManifestFS(fsys fs.FS) (*manifest, error) {
+	src, err := fsys.Open(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return decodeManifest(src)
+}
+
+func decodeManifest(r io.Reader) (*manifest, error) {
+	var mf manifest
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mf); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %w", err)
+	}
+	if err := mf.validate(); err != nil {
+		return nil, err
+	}
+	return &mf, nil
+}
+
+func (mf *manifest) validate() error {
+	known := make(map[string]bool)
+	for _, mod := range mf.Modules {
+		if mod.Name == "" {
+			return fmt.Errorf("manifest: module without name")
+		}
+		if known[mod.Name] {
+			return fmt.Errorf("manifest: duplicate module %q", mod.Name)
+		}
+		known[mod.Name] = true
+	}
+	paths := make(map[string]bool)
+	for _, route := range mf.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("manifest: route %q must be an absolute path", route.Path)
+		}
+		if strings.HasPrefix(route.Module, storeDigestPrefix) {
+			// digest references name no module, see resolveDigests
+			if _, _, _, err := parseModuleRef(route.Module); err != nil {
+				return fmt.Errorf("manifest: route %q: %w", route.Path, err)
+			}
+		} else if !known[moduleRefName(route.Module)] {
+			return fmt.Errorf("manifest: route %q refers to unknown module %q", route.Path, route.Module)
+		}
+		if paths[route.Path] {
+			return fmt.Errorf("manifest: duplicate route %q", route.Path)
+		}
+		paths[route.Path] = true
+	}
+	return nil
+}
+
+// resolveDigests looks up in the store the modules the digest references
+// of the routes are versions of: each must be a version of exactly one
+// of the modules the manifest lists, whose settings it gets.
+// Safe to call on a nil manifest.
+func (mf *manifest) resolveDigests(ms *moduleStore) error {
+	if mf == nil {
+		return nil
+	}
+	listed := make(map[string]bool)
+	for _, mod := range mf.Modules {
+		listed[mod.Name] = true
+	}
+	for _, route := range mf.Routes {
+		if !strings.HasPrefix(route.Module, storeDigestPrefix) {
+			continue
+		}
+		if ms == nil {
+			return fmt.Errorf("manifest: route %q: digest reference %q needs a module store", route.Path, route.Module)
+		}
+		names, err := ms.NamesOf(route.Module)
+		if err != nil {
+			return fmt.Errorf("manifest: route %q: %w", route.Path, err)
+		}
+		var matches []string
+		for _, name := range names {
+			if listed[name] {
+				matches = append(matches, name)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return fmt.Errorf("manifest: route %q refers to %q, which is not a version of any module listed", route.Path, route.Module)
+		case 1:
+		default:
+			return fmt.Errorf("manifest: route %q refers to %q, which is a version of more than one module listed: %v", route.Path, route.Module, matches)
+		}
+		if mf.digestNames == nil {
+			mf.digestNames = make(map[string]string)
+		}
+		mf.digestNames[route.Module] = matches[0]
+	}
+	return nil
+}
+
+// Settings returns the settings for the given module, or the defaults
+// if the module is not listed. Safe to call on a nil manifest.
+// Modules are matched by name, so all the versions share the settings;
+// digest references must be resolved first, see resolveDigests.
+func (mf *manifest) Settings(ref string) moduleSettings {
+	if mf == nil {
+		return moduleSettings{}
+	}
+	name := moduleRefName(ref)
+	if digestName, ok := mf.digestNames[ref]; ok {
+		name = digestName
+	}
+	for _, mod := range mf.Modules {
+		if mod.Name == name {
+			return mod.Settings
+		}
+	}
+	return moduleSettings{}
+}
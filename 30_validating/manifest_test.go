@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeManifest(t *testing.T) {
+	digest := digestOf([]byte("module"))
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{
+		{
+			name:     "valid",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "/echo", "module": "echo"}]}`,
+		},
+		{
+			name:     "version reference",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "/echo", "module": "echo@v1"}]}`,
+		},
+		{
+			name:     "digest reference",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "/echo", "module": "` + digest + `"}]}`,
+		},
+		{
+			name:     "unknown field",
+			manifest: `{"modules": [{"name": "echo", "setting": {}}]}`,
+			wantErr:  "malformed manifest",
+		},
+		{
+			name:     "module without name",
+			manifest: `{"modules": [{"settings": {}}]}`,
+			wantErr:  "module without name",
+		},
+		{
+			name:     "duplicate module",
+			manifest: `{"modules": [{"name": "echo"}, {"name": "echo"}]}`,
+			wantErr:  "duplicate module",
+		},
+		{
+			name:     "relative route",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "echo", "module": "echo"}]}`,
+			wantErr:  "must be an absolute path",
+		},
+		{
+			name:     "unknown module",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "/greet", "module": "greet@v1"}]}`,
+			wantErr:  "unknown module",
+		},
+		{
+			name:     "malformed digest",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "/echo", "module": "sha256:abcd"}]}`,
+			wantErr:  errStoreBadRef.Error(),
+		},
+		{
+			name:     "duplicate route",
+			manifest: `{"modules": [{"name": "echo"}], "routes": [{"path": "/echo", "module": "echo"}, {"path": "/echo", "module": "echo@v1"}]}`,
+			wantErr:  "duplicate route",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeManifest(strings.NewReader(tt.manifest))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManifestResolveDigests(t *testing.T) {
+	ms := newModuleStore(t.TempDir())
+	echo, err := ms.Add("echo@v1", []byte("echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ms.Add("greet@v1", []byte("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Add("hello@v1", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	unlisted, err := ms.Add("other@v1", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const modules = `"modules": [
+		{"name": "echo", "settings": {"fuel": 1000}},
+		{"name": "greet", "settings": {"fuel": 2000}}
+	]`
+	tests := []struct {
+		name    string
+		ref     string
+		store   *moduleStore
+		wantErr string
+	}{
+		{name: "version of one module", ref: echo, store: ms},
+		// hello is not listed: only greet matches
+		{name: "version of modules not listed too", ref: shared, store: ms},
+		{name: "no store", ref: echo, wantErr: "needs a module store"},
+		{name: "not a version of any module listed", ref: unlisted, store: ms, wantErr: "not a version of any module listed"},
+		{name: "not in the store", ref: digestOf([]byte("missing")), store: ms, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mf, err := decodeManifest(strings.NewReader(`{` + modules + `, "routes": [{"path": "/", "module": "` + tt.ref + `"}]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = mf.resolveDigests(tt.store)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one about %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mf.Settings(tt.ref).Fuel; got == 0 {
+				t.Fatalf("got the default settings for %q", tt.ref)
+			}
+		})
+	}
+}
+
+func TestManifestResolveDigestsAmbiguous(t *testing.T) {
+	ms := newModuleStore(t.TempDir())
+	shared, err := ms.Add("echo@v1", []byte("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Add("greet@v1", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := decodeManifest(strings.NewReader(`{
+		"modules": [{"name": "echo"}, {"name": "greet"}],
+		"routes": [{"path": "/", "module": "` + shared + `"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.resolveDigests(ms); err == nil || !strings.Contains(err.Error(), "more than one module") {
+		t.Fatalf("got error %v, want one about the ambiguity", err)
+	}
+}
+
+func TestManifestSettings(t *testing.T) {
+	mf, err := decodeManifest(strings.NewReader(`{"modules": [{"name": "echo", "settings": {"env": {"GREETING": "hi"}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, want := range map[string]string{"echo": "hi", "echo@v2": "hi", "greet": ""} {
+		if got := mf.Settings(ref).Env["GREETING"]; got != want {
+			t.Errorf("%q: got greeting %q, want %q", ref, got, want)
+		}
+	}
+	var noManifest *manifest
+	if got := noManifest.Settings("echo").Env; got != nil {
+		t.Errorf("no manifest: got env %v, want none", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/tetratelabs/wazero"
+)
+
+const (
+	metaSectionName = "httpwasm.meta"
+
+	// hostABILegacy is the ABI assumed for guests without metadata
+	hostABILegacy = 2
+)
+
+// guestMeta is the content of the "httpwasm.meta" custom section, which
+// guests use to declare how they expect to be run. It is JSON encoded:
+//
+//	{"abi": 2, "capabilities": ["io"], "entrypoint": "run", "description": "..."}
+//
+// All the fields are optional; guests without the section at all are
+// assumed to be written against hostABILegacy and to export "run".
+type guestMeta struct {
+	ABI          int      `json:"abi,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Entrypoint   string   `json:"entrypoint,omitempty"`
+	Description  string   `json:"description,omitempty"`
+}
+
+// hostABI is a version of the host interface. All the versions share the
+// same import names, so guests can't tell them apart; what changes is how
+// the host functions behave.
+type hostABI struct {
+	version int
+	// igets reads the request body up to, and including, the delimiter;
+	// igetbody, which all the versions have, reads it all as is
+	delimiter    byte
+	capabilities []string
+}
+
+var hostABIs = map[int]hostABI{
+	// the 20_hostfunctions guests: newline-delimited igets
+	1: {
+		version:      1,
+		delimiter:    '\n',
+		capabilities: []string{"io", "body", "env", "config", "json"},
+	},
+	// the 30_validating guests: NUL-delimited igets
+	2: {
+		version:      2,
+		delimiter:    '\x00',
+		capabilities: []string{"io", "body", "env", "config", "json"},
+	},
+}
+
+func decodeGuestMeta(data []byte) (guestMeta, error) {
+	var meta guestMeta
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&meta); err != nil {
+		return meta, fmt.Errorf("malformed %s section: %w", metaSectionName, err)
+	}
+	if meta.ABI == 0 {
+		meta.ABI = hostABILegacy
+	}
+	if meta.Entrypoint == "" {
+		meta.Entrypoint = runFnName
+	}
+	return meta, nil
+}
+
+// readGuestMeta extracts the guest metadata. The runtime must be configured
+// to keep the custom sections, otherwise all guests look like legacy ones.
+func readGuestMeta(code wazero.CompiledModule) (guestMeta, error) {
+	var found []byte
+	for _, sec := range code.CustomSections() {
+		if sec.Name() != metaSectionName {
+			continue
+		}
+		if found != nil {
+			return guestMeta{}, fmt.Errorf("duplicate %s section", metaSectionName)
+		}
+		found = sec.Data()
+	}
+	if found == nil {
+		return guestMeta{
+			ABI:        hostABILegacy,
+			Entrypoint: runFnName,
+		}, nil
+	}
+	return decodeGuestMeta(found)
+}
+
+// negotiateABI picks the host ABI the guest was written against, and
+// makes sure the host can provide all the capabilities the guest needs.
+func negotiateABI(meta guestMeta) (hostABI, error) {
+	abi, ok := hostABIs[meta.ABI]
+	if !ok {
+		return hostABI{}, fmt.Errorf("unsupported ABI version %d", meta.ABI)
+	}
+	for _, capName := range meta.Capabilities {
+		if !slices.Contains(abi.capabilities, capName) {
+			return hostABI{}, fmt.Errorf("ABI version %d does not provide capability %q", abi.version, capName)
+		}
+	}
+	return abi, nil
+}
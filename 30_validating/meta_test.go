@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// compileWithMeta compiles a guest carrying the given httpwasm.meta
+// sections, keeping the custom sections as the engine does.
+func compileWithMeta(t *testing.T, sections ...string) wazero.CompiledModule {
+	t.Helper()
+	var tm testModule
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+	for _, data := range sections {
+		tm.custom(metaSectionName, []byte(data))
+	}
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCustomSections(true))
+	t.Cleanup(func() { rt.Close(ctx) })
+	code, err := rt.CompileModule(ctx, tm.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestReadGuestMeta(t *testing.T) {
+	tests := []struct {
+		name     string
+		sections []string
+		want     guestMeta
+		wantErr  string
+	}{
+		{name: "missing section", want: guestMeta{ABI: hostABILegacy, Entrypoint: runFnName}},
+		{
+			name:     "complete",
+			sections: []string{`{"abi": 1, "capabilities": ["io"], "entrypoint": "serve", "description": "test"}`},
+			want:     guestMeta{ABI: 1, Capabilities: []string{"io"}, Entrypoint: "serve", Description: "test"},
+		},
+		{name: "defaults", sections: []string{`{}`}, want: guestMeta{ABI: hostABILegacy, Entrypoint: runFnName}},
+		{name: "malformed", sections: []string{`{"abi": 2`}, wantErr: "malformed httpwasm.meta section"},
+		{name: "wrong type", sections: []string{`{"abi": "2"}`}, wantErr: "malformed httpwasm.meta section"},
+		// most likely a typo, which would silently be ignored
+		{name: "unknown field", sections: []string{`{"abi": 2, "capabilites": ["io"]}`}, wantErr: "malformed httpwasm.meta section"},
+		{name: "duplicate", sections: []string{`{}`, `{}`}, wantErr: "duplicate httpwasm.meta section"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := readGuestMeta(compileWithMeta(t, tt.sections...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.ABI != tt.want.ABI || meta.Entrypoint != tt.want.Entrypoint || meta.Description != tt.want.Description ||
+				!slices.Equal(meta.Capabilities, tt.want.Capabilities) {
+				t.Fatalf("got %+v, want %+v", meta, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateABI(t *testing.T) {
+	tests := []struct {
+		name        string
+		meta        guestMeta
+		wantVersion int
+		wantErr     string
+	}{
+		{name: "legacy", meta: guestMeta{ABI: hostABILegacy}, wantVersion: hostABILegacy},
+		{name: "newline delimited", meta: guestMeta{ABI: 1, Capabilities: []string{"io"}}, wantVersion: 1},
+		{name: "ABI mismatch", meta: guestMeta{ABI: 3}, wantErr: "unsupported ABI version 3"},
+		{name: "capability groups", meta: guestMeta{ABI: 2, Capabilities: []string{"io", "body", "env", "config", "json"}}, wantVersion: 2},
+		{name: "unknown capability", meta: guestMeta{ABI: 2, Capabilities: []string{"net"}}, wantErr: `does not provide capability "net"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			abi, err := negotiateABI(tt.meta)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if abi.version != tt.wantVersion {
+				t.Fatalf("got ABI version %d, want %d", abi.version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestEngineRejectsUnsupportedABI(t *testing.T) {
+	var tm testModule
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+	tm.custom(metaSectionName, []byte(`{"abi": 3}`))
+	grants, err := newCapabilityGrants("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := newSandbox(moduleSettings{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newWasmEngine(context.Background(), tm.bytes(), engineOptions{name: "test", grants: grants, sandbox: sb})
+	if err == nil || !strings.Contains(err.Error(), "unsupported ABI version 3") {
+		t.Fatalf("got error %v, want an ABI mismatch", err)
+	}
+}
+
+// the example modules must be loadable with the metadata they ship with
+func TestExampleModulesMeta(t *testing.T) {
+	paths, err := filepath.Glob("modules/*/meta.json")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no example metadata found: %v", err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := decodeGuestMeta(data)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if _, err := negotiateABI(meta); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const metaUsage = `usage: httpwasm meta FILE.wasm META.json
+
+Embeds META.json as the ` + metaSectionName + ` custom section of FILE.wasm,
+replacing the existing one, if any.
+`
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+func metaMain(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, metaUsage)
+		return 2
+	}
+	wasmPath, metaPath := args[0], args[1]
+
+	metaData, err := os.ReadFile(metaPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "meta: %v\n", err)
+		return 1
+	}
+	if _, err := decodeGuestMeta(metaData); err != nil {
+		fmt.Fprintf(os.Stderr, "meta: %v\n", err)
+		return 1
+	}
+	wasmObj, err := os.ReadFile(wasmPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "meta: %v\n", err)
+		return 1
+	}
+	wasmObj, err = setCustomSection(wasmObj, metaSectionName, metaData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "meta: %s: %v\n", wasmPath, err)
+		return 1
+	}
+	if err := writeFileAtomic(wasmPath, wasmObj); err != nil {
+		fmt.Fprintf(os.Stderr, "meta: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// setCustomSection drops all the custom sections with the given name,
+// and appends a new one with the given data. Custom sections can appear
+// anywhere in a binary, so the rest of it is left untouched.
+func setCustomSection(wasmObj []byte, name string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(wasmObj, wasmHeader) {
+		return nil, errors.New("not a wasm binary")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(wasmObj)+len(data)+len(name)+16))
+	out.Write(wasmHeader)
+
+	rest := wasmObj[len(wasmHeader):]
+	for len(rest) > 0 {
+		id := rest[0]
+		size, n := binary.Uvarint(rest[1:])
+		if n <= 0 || uint64(len(rest)-1-n) < size {
+			return nil, errors.New("malformed section")
+		}
+		end := 1 + n + int(size)
+		if id != 0 || customSectionName(rest[1+n:end]) != name {
+			out.Write(rest[:end])
+		}
+		rest = rest[end:]
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(len(name)))
+	payload = append(payload, name...)
+	payload = append(payload, data...)
+	out.WriteByte(0) // custom section id
+	out.Write(binary.AppendUvarint(nil, uint64(len(payload))))
+	out.Write(payload)
+	return out.Bytes(), nil
+}
+
+func customSectionName(payload []byte) string {
+	size, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < size {
+		return ""
+	}
+	return string(payload[n : n+int(size)])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// The WASI application ABI defines two kinds of modules:
+//
+//   - commands export "_start", which runs main. Guests like the TinyGo ones
+//     built with -target=wasi are commands whose main returns: the instance
+//     stays usable afterwards, and the host calls the entrypoint on it.
+//     A command whose main exits, like any standard Go wasip1 program,
+//     leaves nothing to call into and is rejected.
+//   - reactors export "_initialize", which initializes the runtime and
+//     returns; the host calls the entrypoint afterwards. Standard Go 1.24+
+//     guests are reactors when built with -buildmode=c-shared, exporting
+//     the entrypoint with go:wasmexport.
+//
+// Exporting both is an error. Modules exporting neither need no
+// initialization, e.g. hand-written ones.
+const (
+	moduleKindCommand = "command"
+	moduleKindReactor = "reactor"
+	moduleKindLibrary = "library"
+
+	commandStartFn = "_start"
+	reactorInitFn  = "_initialize"
+)
+
+var errCommandExited = errors.New("command module exited during _start")
+
+// detectModuleKind tells how the module must be initialized.
+func detectModuleKind(code wazero.CompiledModule) (string, error) {
+	exports := code.ExportedFunctions()
+	start, isCommand := exports[commandStartFn]
+	init, isReactor := exports[reactorInitFn]
+	switch {
+	case isCommand && isReactor:
+		return "", fmt.Errorf("module exports both %q and %q: cannot be both a command and a reactor", commandStartFn, reactorInitFn)
+	case isCommand:
+		if len(start.ParamTypes()) > 0 || len(start.ResultTypes()) > 0 {
+			return "", fmt.Errorf("%q must take no params and return no results", commandStartFn)
+		}
+		return moduleKindCommand, nil
+	case isReactor:
+		if len(init.ParamTypes()) > 0 || len(init.ResultTypes()) > 0 {
+			return "", fmt.Errorf("%q must take no params and return no results", reactorInitFn)
+		}
+		return moduleKindReactor, nil
+	}
+	return moduleKindLibrary, nil
+}
+
+// startFunctions returns the functions instantiation must run for the kind.
+func startFunctions(kind string) []string {
+	switch kind {
+	case moduleKindCommand:
+		return []string{commandStartFn}
+	case moduleKindReactor:
+		return []string{reactorInitFn}
+	}
+	return nil
+}
+
+// withModuleKind sets up the config to initialize modules of the kind.
+func withModuleKind(config wazero.ModuleConfig, kind string) wazero.ModuleConfig {
+	return config.WithStartFunctions(startFunctions(kind)...)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestDetectModuleKind(t *testing.T) {
+	i32 := api.ValueTypeI32
+	tests := []struct {
+		name    string
+		exports map[string][]api.ValueType
+		want    string
+		wantErr string
+	}{
+		{name: "library", want: moduleKindLibrary},
+		{name: "command", exports: map[string][]api.ValueType{commandStartFn: nil}, want: moduleKindCommand},
+		{name: "reactor", exports: map[string][]api.ValueType{reactorInitFn: nil}, want: moduleKindReactor},
+		{
+			name:    "both",
+			exports: map[string][]api.ValueType{commandStartFn: nil, reactorInitFn: nil},
+			wantErr: "cannot be both a command and a reactor",
+		},
+		{
+			name:    "bad _start signature",
+			exports: map[string][]api.ValueType{commandStartFn: {i32}},
+			wantErr: `"_start" must take no params`,
+		},
+		{
+			name:    "bad _initialize signature",
+			exports: map[string][]api.ValueType{reactorInitFn: {i32}},
+			wantErr: `"_initialize" must take no params`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tm testModule
+			tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+			for name, params := range tt.exports {
+				tm.exportFunc(name, tm.function(params, nil, nil))
+			}
+			ctx := context.Background()
+			rt := wazero.NewRuntime(ctx)
+			t.Cleanup(func() { rt.Close(ctx) })
+			code, err := rt.CompileModule(ctx, tm.bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kind, err := detectModuleKind(code)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != tt.want {
+				t.Fatalf("got kind %q, want %q", kind, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineInitializesModuleKinds(t *testing.T) {
+	i32 := api.ValueTypeI32
+	// initModule writes out a global the start function sets, if any
+	initModule := func(startFn string) []byte {
+		var tm testModule
+		puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+		tm.memoryPages(1)
+		tm.dataAt(0, []byte("01"))
+		initialized := tm.global(i32, true, 0)
+		run := tm.function(nil, nil, nil, opGlobalGet(initialized), opI32Const(1), opCall(puts))
+		tm.exportFunc(runFnName, run)
+		if startFn != "" {
+			tm.exportFunc(startFn, tm.function(nil, nil, nil, opI32Const(1), opGlobalSet(initialized)))
+		}
+		return tm.bytes()
+	}
+
+	tests := []struct {
+		name    string
+		startFn string
+		want    string
+	}{
+		{name: "library", want: "0"},
+		// the instance stays usable after _start returns
+		{name: "command", startFn: commandStartFn, want: "1"},
+		{name: "reactor", startFn: reactorInitFn, want: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := newTestEngine(t, initModule(tt.startFn), moduleSettings{})
+			if got := string(runOutput(t, we, "")); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineRejectsExitedCommands(t *testing.T) {
+	var tm testModule
+	procExit := tm.importFunc("wasi_snapshot_preview1", "proc_exit", []api.ValueType{api.ValueTypeI32}, nil)
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+	tm.exportFunc(commandStartFn, tm.function(nil, nil, nil, opI32Const(0), opCall(procExit)))
+	grants, err := newCapabilityGrants("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := newSandbox(moduleSettings{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newWasmEngine(context.Background(), tm.bytes(), engineOptions{name: "test", grants: grants, sandbox: sb})
+	if !errors.Is(err, errCommandExited) {
+		t.Fatalf("got error %v, want %v", err, errCommandExited)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io"
+
+	"github.com/ffromani/httpwasm-go/hostfunctions/guest"
+)
+
+func init() {
+	guest.Handle(serve)
+}
+
+func serve(w guest.ResponseWriter, r *guest.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		guest.Logf("cannot read the request body: %v", err)
+		return
+	}
+	w.WriteString("hello, " + string(body) + "\n")
+}
+
+func main() {}
@@ -0,0 +1,432 @@
+// Package jsonschema validates JSON documents against a subset of JSON
+// Schema draft 2020-12, small enough for guest modules: the keywords
+// type, properties, required, enum, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, minItems,
+// maxItems, items and $ref, to JSON Pointers within the same document.
+// Other keywords are ignored, like the spec says of unknown ones.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled schema.
+type Schema struct {
+	root     any
+	patterns map[string]*regexp.Regexp
+	// the references whose target was checked, or is being checked
+	checkedRefs map[string]bool
+}
+
+// Violation is a failed validation.
+type Violation struct {
+	// the keyword which failed
+	Keyword string
+	// JSON Pointer to the offending value, or to the missing property
+	Location string
+	// the offending value, nil for missing properties
+	Value   any
+	Message string
+}
+
+// Compile parses the schema and checks the supported keywords.
+func Compile(data []byte) (*Schema, error) {
+	var root any
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	sc := Schema{
+		root:        root,
+		patterns:    make(map[string]*regexp.Regexp),
+		checkedRefs: make(map[string]bool),
+	}
+	if err := sc.check(root, ""); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// check walks the schema, reporting the first error at its JSON Pointer.
+func (sc *Schema) check(schema any, ptr string) error {
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+	obj, ok := schema.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: schema must be an object or a boolean", pointerOrRoot(ptr))
+	}
+	for _, kw := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"} {
+		if val, ok := obj[kw]; ok {
+			if _, ok := val.(float64); !ok {
+				return fmt.Errorf("%s/%s: must be a number", ptr, kw)
+			}
+		}
+	}
+	for _, kw := range []string{"minLength", "maxLength", "minItems", "maxItems"} {
+		if val, ok := obj[kw]; ok {
+			if num, ok := val.(float64); !ok || num < 0 || num != math.Trunc(num) {
+				return fmt.Errorf("%s/%s: must be a non-negative integer", ptr, kw)
+			}
+		}
+	}
+	if val, ok := obj["type"]; ok {
+		if err := checkType(val); err != nil {
+			return fmt.Errorf("%s/type: %w", ptr, err)
+		}
+	}
+	if val, ok := obj["enum"]; ok {
+		if _, ok := val.([]any); !ok {
+			return fmt.Errorf("%s/enum: must be an array", ptr)
+		}
+	}
+	if val, ok := obj["required"]; ok {
+		names, ok := val.([]any)
+		if !ok {
+			return fmt.Errorf("%s/required: must be an array of strings", ptr)
+		}
+		for _, name := range names {
+			if _, ok := name.(string); !ok {
+				return fmt.Errorf("%s/required: must be an array of strings", ptr)
+			}
+		}
+	}
+	if val, ok := obj["pattern"]; ok {
+		pattern, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("%s/pattern: must be a string", ptr)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s/pattern: %w", ptr, err)
+		}
+		sc.patterns[pattern] = re
+	}
+	if val, ok := obj["$ref"]; ok {
+		ref, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("%s/$ref: must be a string", ptr)
+		}
+		target, err := sc.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s/$ref: %w", ptr, err)
+		}
+		// the target can be anywhere in the document, not only where the
+		// walk goes: the validation relies on it being checked too
+		if !sc.checkedRefs[ref] {
+			sc.checkedRefs[ref] = true
+			if err := sc.check(target, strings.TrimPrefix(ref, "#")); err != nil {
+				return err
+			}
+		}
+	}
+	if val, ok := obj["items"]; ok {
+		if err := sc.check(val, ptr+"/items"); err != nil {
+			return err
+		}
+	}
+	for _, kw := range []string{"properties", "$defs", "definitions"} {
+		val, ok := obj[kw]
+		if !ok {
+			continue
+		}
+		subs, ok := val.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s/%s: must be an object", ptr, kw)
+		}
+		for _, name := range sortedKeys(subs) {
+			if err := sc.check(subs[name], ptr+"/"+kw+"/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var typeNames = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+func checkType(val any) error {
+	types, ok := val.([]any)
+	if !ok {
+		types = []any{val}
+	}
+	for _, typ := range types {
+		name, ok := typ.(string)
+		if !ok {
+			return fmt.Errorf("must be a string or an array of strings")
+		}
+		known := false
+		for _, typeName := range typeNames {
+			known = known || name == typeName
+		}
+		if !known {
+			return fmt.Errorf("unknown type %q", name)
+		}
+	}
+	return nil
+}
+
+// resolve returns the schema the reference points to. Only references
+// within the document are supported: "#" followed by a JSON Pointer.
+func (sc *Schema) resolve(ref string) (any, error) {
+	ptr, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("unsupported reference %q: only references within the schema are", ref)
+	}
+	cur := sc.root
+	if ptr == "" {
+		return cur, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("unsupported reference %q: anchors are not", ref)
+	}
+	for _, token := range strings.Split(ptr[1:], "/") {
+		token = unescapePointer(token)
+		switch node := cur.(type) {
+		case map[string]any:
+			cur, ok = node[token]
+		case []any:
+			idx, err := strconv.Atoi(token)
+			ok = err == nil && idx >= 0 && idx < len(node)
+			if ok {
+				cur = node[idx]
+			}
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+	}
+	return cur, nil
+}
+
+// Validate returns all the violations of the document, decoded with
+// encoding/json, in a stable order.
+func (sc *Schema) Validate(doc any) []Violation {
+	vr := validator{schema: sc}
+	vr.validate(sc.root, doc, "")
+	return vr.violations
+}
+
+type validator struct {
+	schema     *Schema
+	violations []Violation
+	// the references being followed, to stop on cycles which don't
+	// descend in the document
+	following []string
+}
+
+func (vr *validator) fail(keyword, location string, value any, format string, args ...any) {
+	v := Violation{
+		Keyword:  keyword,
+		Location: location,
+		Value:    value,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	// references may apply the same schema twice to the same value
+	for _, seen := range vr.violations {
+		if seen.Keyword == v.Keyword && seen.Location == v.Location && seen.Message == v.Message {
+			return
+		}
+	}
+	vr.violations = append(vr.violations, v)
+}
+
+func (vr *validator) validate(schema, doc any, ptr string) {
+	if accept, ok := schema.(bool); ok {
+		if !accept {
+			vr.fail("false", ptr, doc, "no value is allowed")
+		}
+		return
+	}
+	obj, ok := schema.(map[string]any)
+	if !ok {
+		return
+	}
+
+	if ref, ok := obj["$ref"].(string); ok {
+		vr.validateRef(ref, doc, ptr)
+	}
+	if typ, ok := obj["type"]; ok && !matchesType(typ, doc) {
+		vr.fail("type", ptr, doc, "expected %s, got %s", typeString(typ), typeOf(doc))
+		// the other keywords would only repeat the mismatch
+		return
+	}
+	if enum, ok := obj["enum"].([]any); ok {
+		found := false
+		for _, val := range enum {
+			found = found || reflect.DeepEqual(val, doc)
+		}
+		if !found {
+			vr.fail("enum", ptr, doc, "not one of the allowed values")
+		}
+	}
+
+	switch val := doc.(type) {
+	case string:
+		vr.validateString(obj, val, ptr)
+	case float64:
+		vr.validateNumber(obj, val, ptr)
+	case []any:
+		vr.validateArray(obj, val, ptr)
+	case map[string]any:
+		vr.validateObject(obj, val, ptr)
+	}
+}
+
+func (vr *validator) validateRef(ref string, doc any, ptr string) {
+	key := ref + " " + ptr
+	for _, following := range vr.following {
+		if following == key {
+			return
+		}
+	}
+	target, err := vr.schema.resolve(ref)
+	if err != nil {
+		// can't happen, compile resolved it already
+		vr.fail("$ref", ptr, doc, "%v", err)
+		return
+	}
+	vr.following = append(vr.following, key)
+	vr.validate(target, doc, ptr)
+	vr.following = vr.following[:len(vr.following)-1]
+}
+
+func (vr *validator) validateString(obj map[string]any, val string, ptr string) {
+	length := float64(utf8.RuneCountInString(val))
+	if limit, ok := obj["minLength"].(float64); ok && length < limit {
+		vr.fail("minLength", ptr, val, "shorter than %v characters", limit)
+	}
+	if limit, ok := obj["maxLength"].(float64); ok && length > limit {
+		vr.fail("maxLength", ptr, val, "longer than %v characters", limit)
+	}
+	if pattern, ok := obj["pattern"].(string); ok && !vr.schema.patterns[pattern].MatchString(val) {
+		vr.fail("pattern", ptr, val, "does not match %q", pattern)
+	}
+}
+
+func (vr *validator) validateNumber(obj map[string]any, val float64, ptr string) {
+	if limit, ok := obj["minimum"].(float64); ok && val < limit {
+		vr.fail("minimum", ptr, val, "less than %v", limit)
+	}
+	if limit, ok := obj["maximum"].(float64); ok && val > limit {
+		vr.fail("maximum", ptr, val, "greater than %v", limit)
+	}
+	if limit, ok := obj["exclusiveMinimum"].(float64); ok && val <= limit {
+		vr.fail("exclusiveMinimum", ptr, val, "not greater than %v", limit)
+	}
+	if limit, ok := obj["exclusiveMaximum"].(float64); ok && val >= limit {
+		vr.fail("exclusiveMaximum", ptr, val, "not less than %v", limit)
+	}
+}
+
+func (vr *validator) validateArray(obj map[string]any, val []any, ptr string) {
+	length := float64(len(val))
+	if limit, ok := obj["minItems"].(float64); ok && length < limit {
+		vr.fail("minItems", ptr, val, "fewer than %v items", limit)
+	}
+	if limit, ok := obj["maxItems"].(float64); ok && length > limit {
+		vr.fail("maxItems", ptr, val, "more than %v items", limit)
+	}
+	if items, ok := obj["items"]; ok {
+		for idx, item := range val {
+			vr.validate(items, item, ptr+"/"+strconv.Itoa(idx))
+		}
+	}
+}
+
+func (vr *validator) validateObject(obj map[string]any, val map[string]any, ptr string) {
+	if required, ok := obj["required"].([]any); ok {
+		for _, name := range required {
+			name := name.(string)
+			if _, ok := val[name]; !ok {
+				vr.fail("required", ptr+"/"+escapePointer(name), nil, "missing required property %q", name)
+			}
+		}
+	}
+	if props, ok := obj["properties"].(map[string]any); ok {
+		for _, name := range sortedKeys(props) {
+			if prop, ok := val[name]; ok {
+				vr.validate(props[name], prop, ptr+"/"+escapePointer(name))
+			}
+		}
+	}
+}
+
+func matchesType(typ, doc any) bool {
+	types, ok := typ.([]any)
+	if !ok {
+		types = []any{typ}
+	}
+	actual := typeOf(doc)
+	for _, name := range types {
+		if name == actual || name == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(doc any) string {
+	switch val := doc.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+func typeString(typ any) string {
+	types, ok := typ.([]any)
+	if !ok {
+		return fmt.Sprint(typ)
+	}
+	names := make([]string, 0, len(types))
+	for _, name := range types {
+		names = append(names, fmt.Sprint(name))
+	}
+	return strings.Join(names, " or ")
+}
+
+func sortedKeys(obj map[string]any) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func pointerOrRoot(ptr string) string {
+	if ptr == "" {
+		return "root"
+	}
+	return ptr
+}
+
+// escapePointer escapes a JSON Pointer reference token, see RFC 6901.
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+func unescapePointer(token string) string {
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+}
@@ -0,0 +1,186 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileChecksReferenceTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string
+	}{
+		{
+			name:    "pattern outside the walked keywords",
+			schema:  `{"$ref": "#/x-other/name", "x-other": {"name": {"pattern": "("}}}`,
+			wantErr: "/x-other/name/pattern",
+		},
+		{
+			name:    "required entry not a string",
+			schema:  `{"$ref": "#/x-other", "x-other": {"required": [1]}}`,
+			wantErr: "/x-other/required",
+		},
+		{
+			name:    "reference to a reference",
+			schema:  `{"$ref": "#/a", "a": {"$ref": "#/b"}, "b": {"type": "nope"}}`,
+			wantErr: "/b/type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReferenceTargetsValidate(t *testing.T) {
+	sc, err := Compile([]byte(`{
+		"type": "object",
+		"properties": {"id": {"$ref": "#/x-types/id"}, "self": {"$ref": "#"}},
+		"x-types": {"id": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(`{"id": "abc1", "self": {"id": "ok"}}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	got := sc.Validate(doc)
+	if len(got) != 1 || got[0].Keyword != "pattern" || got[0].Location != "/id" {
+		t.Fatalf("got violations %+v, want a pattern one at /id", got)
+	}
+}
+
+// violation is what the tests check of a Violation.
+type violation struct {
+	keyword  string
+	location string
+}
+
+func validate(t *testing.T, schema, doc string) []violation {
+	t.Helper()
+	sc, err := Compile([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var val any
+	if err := json.Unmarshal([]byte(doc), &val); err != nil {
+		t.Fatal(err)
+	}
+	var got []violation
+	for _, v := range sc.Validate(val) {
+		got = append(got, violation{keyword: v.Keyword, location: v.Location})
+	}
+	return got
+}
+
+func TestKeywords(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		doc    string
+		want   []violation
+	}{
+		{name: "type", schema: `{"type": "string"}`, doc: `"a"`},
+		{name: "type mismatch", schema: `{"type": "string"}`, doc: `1`, want: []violation{{"type", ""}}},
+		{name: "type list", schema: `{"type": ["string", "null"]}`, doc: `null`},
+		{name: "integer is a number", schema: `{"type": "number"}`, doc: `1`},
+		{name: "number is not an integer", schema: `{"type": "integer"}`, doc: `1.5`, want: []violation{{"type", ""}}},
+		// the other keywords would only repeat the mismatch
+		{name: "type mismatch stops", schema: `{"type": "string", "minimum": 2}`, doc: `1`, want: []violation{{"type", ""}}},
+
+		{name: "properties", schema: `{"properties": {"a": {"type": "string"}}}`, doc: `{"a": "x", "b": 1}`},
+		{
+			name:   "properties mismatch",
+			schema: `{"properties": {"a": {"type": "string"}, "b/c": {"type": "string"}}}`,
+			doc:    `{"a": 1, "b/c": 2}`,
+			want:   []violation{{"type", "/a"}, {"type", "/b~1c"}},
+		},
+		{name: "properties of non objects", schema: `{"properties": {"a": {"type": "string"}}}`, doc: `[1]`},
+
+		{name: "required", schema: `{"required": ["a"]}`, doc: `{"a": null}`},
+		{name: "required missing", schema: `{"required": ["a", "b"]}`, doc: `{"b": 1}`, want: []violation{{"required", "/a"}}},
+		{
+			name:   "required nested",
+			schema: `{"properties": {"name": {"required": ["first"]}}}`,
+			doc:    `{"name": {}}`,
+			want:   []violation{{"required", "/name/first"}},
+		},
+
+		{name: "minimum", schema: `{"minimum": 1}`, doc: `1`},
+		{name: "under minimum", schema: `{"minimum": 1}`, doc: `0.5`, want: []violation{{"minimum", ""}}},
+		{name: "maximum", schema: `{"maximum": 1}`, doc: `1`},
+		{name: "over maximum", schema: `{"maximum": 1}`, doc: `1.5`, want: []violation{{"maximum", ""}}},
+		{name: "exclusive minimum", schema: `{"exclusiveMinimum": 1}`, doc: `1`, want: []violation{{"exclusiveMinimum", ""}}},
+		{name: "exclusive maximum", schema: `{"exclusiveMaximum": 1}`, doc: `1`, want: []violation{{"exclusiveMaximum", ""}}},
+		{name: "range of non numbers", schema: `{"minimum": 1, "maximum": 2}`, doc: `"a"`},
+
+		{name: "items", schema: `{"items": {"type": "integer"}}`, doc: `[1, 2]`},
+		{name: "items mismatch", schema: `{"items": {"type": "integer"}}`, doc: `[1, "a", 2, null]`, want: []violation{{"type", "/1"}, {"type", "/3"}}},
+		{name: "min items", schema: `{"minItems": 2}`, doc: `[1]`, want: []violation{{"minItems", ""}}},
+		{name: "max items", schema: `{"maxItems": 1}`, doc: `[1, 2]`, want: []violation{{"maxItems", ""}}},
+
+		{name: "enum", schema: `{"enum": ["a", 1, {"b": [null]}]}`, doc: `{"b": [null]}`},
+		{name: "enum mismatch", schema: `{"enum": ["a", 1]}`, doc: `"1"`, want: []violation{{"enum", ""}}},
+
+		{name: "min length", schema: `{"minLength": 2}`, doc: `"é"`, want: []violation{{"minLength", ""}}},
+		{name: "max length", schema: `{"maxLength": 2}`, doc: `"éé"`},
+		{name: "pattern", schema: `{"pattern": "^[a-z]+$"}`, doc: `"a1"`, want: []violation{{"pattern", ""}}},
+		{name: "false schema", schema: `{"properties": {"a": false}}`, doc: `{"a": 1}`, want: []violation{{"false", "/a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validate(t, tt.schema, tt.doc); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got violations %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileChecksKeywords(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string
+	}{
+		{name: "unknown type", schema: `{"type": "float"}`, wantErr: `/type: unknown type "float"`},
+		{name: "type not a string", schema: `{"type": 1}`, wantErr: "/type: must be a string"},
+		{name: "properties not an object", schema: `{"properties": []}`, wantErr: "/properties: must be an object"},
+		{name: "required not an array", schema: `{"required": "a"}`, wantErr: "/required: must be an array of strings"},
+		{name: "minimum not a number", schema: `{"minimum": "1"}`, wantErr: "/minimum: must be a number"},
+		{name: "negative min items", schema: `{"minItems": -1}`, wantErr: "/minItems: must be a non-negative integer"},
+		{name: "items", schema: `{"items": {"maximum": null}}`, wantErr: "/items/maximum: must be a number"},
+		{name: "enum not an array", schema: `{"enum": "a"}`, wantErr: "/enum: must be an array"},
+		{name: "bad pattern", schema: `{"properties": {"a": {"pattern": "("}}}`, wantErr: "/properties/a/pattern"},
+		{name: "external reference", schema: `{"$ref": "other.json#/a"}`, wantErr: "only references within the schema"},
+		{name: "not a schema", schema: `[]`, wantErr: "root: schema must be an object or a boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// unsupported keywords are ignored, like the spec says of unknown ones:
+// they neither fail the compilation nor restrict the documents
+func TestUnsupportedKeywords(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {"n": {"type": "number", "multipleOf": 2}, "s": {"format": "email"}}
+	}`
+	if got := validate(t, schema, `{"n": 3, "s": "not an email", "extra": true}`); got != nil {
+		t.Fatalf("got violations %v, want none", got)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build wasm
+
+package main
+
+import "github.com/ffromani/httpwasm-go/hostfunctions/guest"
+
+// the configuration is parsed once, when the instance is initialized:
+// a bad one fails the module load, rather than every request. Outside of
+// wasm there is no host to read it from, so the package can be tested.
+func init() {
+	var err error
+	rules, schema, err = loadConfig(guest.Config())
+	if err != nil {
+		guest.Logf("invalid configuration: %v", err)
+		panic(err)
+	}
+	guest.Handle(serve)
+}
@@ -0,0 +1,298 @@
+package main
+
+// validate checks JSON request bodies against the rules in the module
+// configuration, and reports all the rules they break:
+//
+//	{"rules": [
+//		{"path": "name.last", "op": "required", "code": 1, "description": "missing last name"},
+//		{"path": "name.last", "op": "equals", "value": "Doe", "code": 2, "description": "mismatched last name"},
+//		{"path": "age", "op": "range", "min": 0, "max": 150, "code": 3, "description": "invalid age"}
+//	]}
+//
+// The paths are gjson paths. The operators are:
+//   - required: the field must be present, even if null
+//   - equals: the field text must be value
+//   - regex: the field text must match pattern
+//   - range: the field must be a number between min and max, inclusive;
+//     either can be omitted
+//   - enum: the field text must be one of values
+//   - type: the field must be of type: string, number, boolean, null,
+//     object or array
+//
+// All the operators but required ignore missing fields. Without
+// configuration, the module checks the last name is Doe.
+//
+// The configuration can also hold a JSON Schema, see the jsonschema
+// package for the supported subset, which the body is validated against:
+//
+//	{"schema": {"type": "object", "required": ["name"], ...}}
+//
+// The schema violations are reported like the rule ones, the field being
+// the JSON Pointer to the offending value, and the code depending on the
+// failed keyword, see schemaCodes. The rules, if any, are checked too.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+
+	"github.com/ffromani/httpwasm-go/hostfunctions/guest"
+	"github.com/ffromani/httpwasm-go/hostfunctions/modules/jsonschema"
+)
+
+const (
+	opRequired = "required"
+	opEquals   = "equals"
+	opRegex    = "regex"
+	opRange    = "range"
+	opEnum     = "enum"
+	opType     = "type"
+)
+
+var jsonTypes = []string{"string", "number", "boolean", "null", "object", "array"}
+
+// the codes of the schema violations; bodies which aren't JSON at all
+// get codeInvalidJSON
+const codeInvalidJSON = 100
+
+var schemaCodes = map[string]int{
+	"type":             101,
+	"required":         102,
+	"enum":             103,
+	"pattern":          104,
+	"minimum":          105,
+	"maximum":          105,
+	"exclusiveMinimum": 105,
+	"exclusiveMaximum": 105,
+	"minLength":        106,
+	"maxLength":        106,
+	"minItems":         107,
+	"maxItems":         107,
+	"false":            108,
+}
+
+type rule struct {
+	Path        string   `json:"path"`
+	Op          string   `json:"op"`
+	Value       string   `json:"value,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Values      []string `json:"values,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Code        int      `json:"code"`
+	Description string   `json:"description"`
+
+	re *regexp.Regexp
+}
+
+type config struct {
+	Rules  []rule          `json:"rules,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+var defaultRules = []rule{
+	{Path: "name.last", Op: opRequired, Code: 1, Description: "missing last name"},
+	{Path: "name.last", Op: opEquals, Value: "Doe", Code: 1, Description: "mismatched last name"},
+}
+
+var (
+	rules  []rule
+	schema *jsonschema.Schema
+)
+
+// the fields are looked up by the host: the body is never read
+// unless there is a schema
+func serve(w guest.ResponseWriter, r *guest.Request) {
+	var violations []violation
+	if schema != nil {
+		violations = validateSchema(r, schema)
+	}
+	violations = append(violations, validate(r, rules)...)
+	w.Write(makeResponse(violations))
+}
+
+func loadConfig(data []byte) ([]rule, *jsonschema.Schema, error) {
+	if len(data) == 0 {
+		return defaultRules, nil, nil
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, err
+	}
+	if len(cfg.Rules) == 0 && cfg.Schema == nil {
+		return nil, nil, errors.New("neither rules nor schema")
+	}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			return nil, nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	if cfg.Schema == nil {
+		return cfg.Rules, nil, nil
+	}
+	sc, err := jsonschema.Compile(cfg.Schema)
+	if err != nil {
+		return nil, nil, fmt.Errorf("schema: %w", err)
+	}
+	return cfg.Rules, sc, nil
+}
+
+func (rl *rule) compile() error {
+	if rl.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	switch rl.Op {
+	case opRequired, opEquals:
+	case opRegex:
+		re, err := regexp.Compile(rl.Pattern)
+		if err != nil {
+			return err
+		}
+		rl.re = re
+	case opRange:
+		if rl.Min == nil && rl.Max == nil {
+			return fmt.Errorf("range without min nor max")
+		}
+	case opEnum:
+		if len(rl.Values) == 0 {
+			return fmt.Errorf("enum without values")
+		}
+	case opType:
+		if !slices.Contains(jsonTypes, rl.Type) {
+			return fmt.Errorf("unknown type %q", rl.Type)
+		}
+	default:
+		return fmt.Errorf("unknown operator %q", rl.Op)
+	}
+	return nil
+}
+
+type violation struct {
+	Code        int    `json:"code"`
+	Field       string `json:"field"`
+	Value       string `json:"value"`
+	Description string `json:"description"`
+}
+
+func validate(r *guest.Request, rules []rule) []violation {
+	var violations []violation
+	for i := range rules {
+		rl := &rules[i]
+		value := r.JSON(rl.Path)
+		if !rl.check(value) {
+			violations = append(violations, violation{
+				Code:        rl.Code,
+				Field:       rl.Path,
+				Value:       value.String(),
+				Description: rl.Description,
+			})
+		}
+	}
+	return violations
+}
+
+// validateSchema needs the whole body, unlike the rules.
+func validateSchema(r *guest.Request, sc *jsonschema.Schema) []violation {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		guest.Logf("cannot read the request body: %v", err)
+		panic(err)
+	}
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return []violation{{
+			Code:        codeInvalidJSON,
+			Description: "invalid JSON: " + err.Error(),
+		}}
+	}
+	var violations []violation
+	for _, sv := range sc.Validate(doc) {
+		violations = append(violations, violation{
+			Code:        schemaCodes[sv.Keyword],
+			Field:       sv.Location,
+			Value:       valueText(sv.Value),
+			Description: sv.Message,
+		})
+	}
+	return violations
+}
+
+// valueText formats values like the rule violations do: the text of
+// strings, the JSON text otherwise.
+func valueText(value any) string {
+	switch val := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func (rl *rule) check(value guest.JSONValue) bool {
+	if rl.Op == opRequired {
+		return value.Exists()
+	}
+	if !value.Exists() {
+		return true
+	}
+	switch rl.Op {
+	case opEquals:
+		return value.String() == rl.Value
+	case opRegex:
+		return rl.re.MatchString(value.String())
+	case opRange:
+		num, ok := value.Float()
+		return ok && (rl.Min == nil || num >= *rl.Min) && (rl.Max == nil || num <= *rl.Max)
+	case opEnum:
+		return slices.Contains(rl.Values, value.String())
+	case opType:
+		return typeName(value) == rl.Type
+	}
+	return false
+}
+
+func typeName(value guest.JSONValue) string {
+	switch value.Type {
+	case guest.JSONString:
+		return "string"
+	case guest.JSONNumber:
+		return "number"
+	case guest.JSONBool:
+		return "boolean"
+	case guest.JSONNull:
+		return "null"
+	}
+	if len(value.Raw) > 0 && value.Raw[0] == '[' {
+		return "array"
+	}
+	return "object"
+}
+
+type reason struct {
+	Violations []violation `json:"violations,omitempty"`
+}
+
+type response struct {
+	Status string `json:"status"`
+	Reason reason `json:"reason"`
+}
+
+func makeResponse(violations []violation) []byte {
+	resp := response{
+		Status: "success",
+		Reason: reason{Violations: violations},
+	}
+	if len(violations) > 0 {
+		resp.Status = "error"
+	}
+	data, _ := json.Marshal(resp)
+	return data
+}
+
+func main() {}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ffromani/httpwasm-go/hostfunctions/guest"
+)
+
+func ptr(f float64) *float64 { return &f }
+
+func TestRuleCheck(t *testing.T) {
+	missing := guest.JSONValue{}
+	null := guest.JSONValue{Type: guest.JSONNull, Raw: "null"}
+	str := func(s string) guest.JSONValue { return guest.JSONValue{Type: guest.JSONString, Raw: s} }
+	num := func(s string) guest.JSONValue { return guest.JSONValue{Type: guest.JSONNumber, Raw: s} }
+
+	tests := []struct {
+		name  string
+		rule  rule
+		value guest.JSONValue
+		want  bool
+	}{
+		{name: "required", rule: rule{Op: opRequired}, value: str("Doe"), want: true},
+		{name: "required null", rule: rule{Op: opRequired}, value: null, want: true},
+		{name: "required missing", rule: rule{Op: opRequired}, value: missing},
+
+		{name: "equals", rule: rule{Op: opEquals, Value: "Doe"}, value: str("Doe"), want: true},
+		{name: "not equals", rule: rule{Op: opEquals, Value: "Doe"}, value: str("Roe")},
+		// all the operators but required ignore missing fields
+		{name: "equals missing", rule: rule{Op: opEquals, Value: "Doe"}, value: missing, want: true},
+
+		{name: "in range", rule: rule{Op: opRange, Min: ptr(0), Max: ptr(150)}, value: num("42"), want: true},
+		{name: "range bounds", rule: rule{Op: opRange, Min: ptr(0), Max: ptr(150)}, value: num("150"), want: true},
+		{name: "under range", rule: rule{Op: opRange, Min: ptr(0), Max: ptr(150)}, value: num("-1")},
+		{name: "over range", rule: rule{Op: opRange, Min: ptr(0), Max: ptr(150)}, value: num("150.5")},
+		{name: "min only", rule: rule{Op: opRange, Min: ptr(18)}, value: num("1e6"), want: true},
+		{name: "max only", rule: rule{Op: opRange, Max: ptr(18)}, value: num("19")},
+		{name: "range of a string", rule: rule{Op: opRange, Min: ptr(0)}, value: str("42")},
+		{name: "range missing", rule: rule{Op: opRange, Min: ptr(0)}, value: missing, want: true},
+
+		{name: "enum", rule: rule{Op: opEnum, Values: []string{"a", "b"}}, value: str("b"), want: true},
+		{name: "not in enum", rule: rule{Op: opEnum, Values: []string{"a", "b"}}, value: str("c")},
+
+		{name: "type", rule: rule{Op: opType, Type: "array"}, value: guest.JSONValue{Type: guest.JSONObjectOrArray, Raw: "[1]"}, want: true},
+		{name: "type mismatch", rule: rule{Op: opType, Type: "array"}, value: guest.JSONValue{Type: guest.JSONObjectOrArray, Raw: "{}"}},
+		{name: "null type", rule: rule{Op: opType, Type: "null"}, value: null, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := tt.rule
+			rl.Path = "field"
+			if err := rl.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := rl.check(tt.value); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegexRule(t *testing.T) {
+	rl := rule{Path: "id", Op: opRegex, Pattern: "^[a-z]+$"}
+	if err := rl.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !rl.check(guest.JSONValue{Type: guest.JSONString, Raw: "abc"}) || rl.check(guest.JSONValue{Type: guest.JSONString, Raw: "ab1"}) {
+		t.Fatal("the pattern was not applied")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantRules  int
+		wantSchema bool
+		wantErr    string
+	}{
+		{name: "default", wantRules: len(defaultRules)},
+		{name: "rules", config: `{"rules": [{"path": "age", "op": "range", "min": 0, "code": 3}]}`, wantRules: 1},
+		{name: "schema", config: `{"schema": {"type": "object"}}`, wantSchema: true},
+		{name: "both", config: `{"rules": [{"path": "a", "op": "required"}], "schema": true}`, wantRules: 1, wantSchema: true},
+		{name: "empty", config: `{}`, wantErr: "neither rules nor schema"},
+		{name: "not JSON", config: `{`, wantErr: "unexpected end of JSON input"},
+		{name: "missing path", config: `{"rules": [{"op": "required"}]}`, wantErr: "rule 0: missing path"},
+		{name: "unknown operator", config: `{"rules": [{"path": "a", "op": "like"}]}`, wantErr: `rule 0: unknown operator "like"`},
+		{name: "range without bounds", config: `{"rules": [{"path": "a", "op": "required"}, {"path": "a", "op": "range"}]}`, wantErr: "rule 1: range without min nor max"},
+		{name: "enum without values", config: `{"rules": [{"path": "a", "op": "enum"}]}`, wantErr: "rule 0: enum without values"},
+		{name: "unknown type", config: `{"rules": [{"path": "a", "op": "type", "type": "int"}]}`, wantErr: `rule 0: unknown type "int"`},
+		{name: "bad regex", config: `{"rules": [{"path": "a", "op": "regex", "pattern": "("}]}`, wantErr: "rule 0: error parsing regexp"},
+		{name: "bad schema", config: `{"schema": {"type": "int"}}`, wantErr: "schema: /type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, sc, err := loadConfig([]byte(tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != tt.wantRules || (sc != nil) != tt.wantSchema {
+				t.Fatalf("got %d rules, schema %v, want %d rules, schema %v", len(rules), sc != nil, tt.wantRules, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestSchemaViolationCodes(t *testing.T) {
+	_, sc, err := loadConfig([]byte(`{"schema": {
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"maxItems": 1, "items": {"enum": ["a", "b"]}},
+			"id": {"pattern": "^[a-z]+$", "minLength": 2}
+		}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		body string
+		want []violation
+	}{
+		{name: "valid", body: `{"name": "x", "age": 1, "tags": ["a"], "id": "ab"}`},
+		{name: "invalid JSON", body: `{"name"`, want: []violation{{Code: codeInvalidJSON, Description: "invalid JSON: unexpected end of JSON input"}}},
+		{name: "type", body: `[]`, want: []violation{{Code: 101, Value: "[]", Description: "expected object, got array"}}},
+		{name: "required", body: `{}`, want: []violation{{Code: 102, Field: "/name", Description: `missing required property "name"`}}},
+		{
+			name: "keywords",
+			body: `{"name": "x", "age": -1, "tags": ["a", "c"], "id": "1"}`,
+			want: []violation{
+				{Code: 105, Field: "/age", Value: "-1", Description: "less than 0"},
+				{Code: 106, Field: "/id", Value: "1", Description: "shorter than 2 characters"},
+				{Code: 104, Field: "/id", Value: "1", Description: `does not match "^[a-z]+$"`},
+				{Code: 107, Field: "/tags", Value: `["a","c"]`, Description: "more than 1 items"},
+				{Code: 103, Field: "/tags/1", Value: "c", Description: "not one of the allowed values"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validateSchema(&guest.Request{Body: strings.NewReader(tt.body)}, sc)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got violations %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		violations []violation
+		want       string
+	}{
+		{name: "success", want: `{"status":"success","reason":{}}`},
+		{
+			name:       "error",
+			violations: []violation{{Code: 3, Field: "age", Value: "200", Description: "invalid age"}},
+			want:       `{"status":"error","reason":{"violations":[{"code":3,"field":"age","value":"200","description":"invalid age"}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := makeResponse(tt.violations)
+			if string(got) != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// guestExport is a function the host expects the guest to export.
+type guestExport struct {
+	name    string
+	params  []api.ValueType
+	results []api.ValueType
+}
+
+// allocatingHostFunctions return data in memory they allocate through
+// the guest malloc and free exports. The other host functions write in
+// buffers the guest provides: guests not importing any of these need
+// no allocator exports.
+var allocatingHostFunctions = []string{"igets", "igetbody", "igetenv"}
+
+func requiredGuestExports(entrypoint string, allocator bool) []guestExport {
+	exports := []guestExport{
+		{name: entrypoint},
+	}
+	if allocator {
+		exports = append(exports,
+			guestExport{name: "malloc", params: []api.ValueType{api.ValueTypeI32}, results: []api.ValueType{api.ValueTypeI32}},
+			guestExport{name: "free", params: []api.ValueType{api.ValueTypeI32}},
+		)
+	}
+	return exports
+}
+
+// needsAllocator tells if the guest imports any allocating host function.
+func needsAllocator(guest wazero.CompiledModule) bool {
+	for _, def := range guest.ImportedFunctions() {
+		modName, fnName, _ := def.Import()
+		if modName == hostModuleName && slices.Contains(allocatingHostFunctions, fnName) {
+			return true
+		}
+	}
+	return false
+}
+
+// preflightError reports all the incompatibilities between a guest
+// and the host at once, so they can be fixed in one go.
+type preflightError struct {
+	problems []string
+}
+
+func (pe *preflightError) Error() string {
+	return fmt.Sprintf("module incompatible with host (%d problems):\n  - %s", len(pe.problems), strings.Join(pe.problems, "\n  - "))
+}
+
+// preflightCheck verifies, before instantiation, that all the functions
+// the guest imports are provided by the host modules with the expected
+// signatures, and that the guest exports all the functions the host needs,
+// including the given entrypoint, and the allocator if the imports need
+// it. Host functions must also be granted.
+func preflightCheck(guest wazero.CompiledModule, entrypoint string, grants *capabilityGrants, hosts ...wazero.CompiledModule) error {
+	provided := make(map[string]map[string]api.FunctionDefinition)
+	for _, host := range hosts {
+		provided[host.Name()] = host.ExportedFunctions()
+	}
+
+	var problems []string
+	for _, def := range guest.ImportedFunctions() {
+		modName, fnName, _ := def.Import()
+		hostFns, ok := provided[modName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("imports %s.%s: unknown host module %q", modName, fnName, modName))
+			continue
+		}
+		hostDef, ok := hostFns[fnName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("imports %s.%s: function not provided by the host", modName, fnName))
+			continue
+		}
+		if !sameSignature(def.ParamTypes(), def.ResultTypes(), hostDef.ParamTypes(), hostDef.ResultTypes()) {
+			problems = append(problems, fmt.Sprintf("imports %s.%s as %s, but host provides %s", modName, fnName, signatureString(def.ParamTypes(), def.ResultTypes()), signatureString(hostDef.ParamTypes(), hostDef.ResultTypes())))
+		}
+		if modName == hostModuleName && !grants.Allowed(fnName) {
+			grants.recordDenial("import of", fnName)
+			problems = append(problems, fmt.Sprintf("imports %s.%s: capability not granted", modName, fnName))
+		}
+	}
+
+	exported := guest.ExportedFunctions()
+	for _, exp := range requiredGuestExports(entrypoint, needsAllocator(guest)) {
+		def, ok := exported[exp.name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing export %q %s", exp.name, signatureString(exp.params, exp.results)))
+			continue
+		}
+		if !sameSignature(def.ParamTypes(), def.ResultTypes(), exp.params, exp.results) {
+			problems = append(problems, fmt.Sprintf("exports %q as %s, but host expects %s", exp.name, signatureString(def.ParamTypes(), def.ResultTypes()), signatureString(exp.params, exp.results)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &preflightError{problems: problems}
+	}
+	return nil
+}
+
+func sameSignature(params, results, otherParams, otherResults []api.ValueType) bool {
+	return slices.Equal(params, otherParams) && slices.Equal(results, otherResults)
+}
+
+func signatureString(params, results []api.ValueType) string {
+	return "(" + valueTypesString(params) + ") -> (" + valueTypesString(results) + ")"
+}
+
+func valueTypesString(vts []api.ValueType) string {
+	names := make([]string, 0, len(vts))
+	for _, vt := range vts {
+		names = append(names, api.ValueTypeName(vt))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func compileTestModules(t *testing.T, wasmObj []byte) (guest, wasi, host wazero.CompiledModule) {
+	t.Helper()
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	t.Cleanup(func() { rt.Close(ctx) })
+	var err error
+	if wasi, err = wasi_snapshot_preview1.NewBuilder(rt).Compile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if host, err = newHostModuleBuilder(rt, hostABIs[hostABILegacy]).Compile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if guest, err = rt.CompileModule(ctx, wasmObj); err != nil {
+		t.Fatal(err)
+	}
+	return guest, wasi, host
+}
+
+func TestPreflightCheck(t *testing.T) {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	ioParams := []api.ValueType{i32, i32}
+	tests := []struct {
+		name  string
+		build func(tm *testModule)
+		// the entrypoint is added unless the module has its own
+		ownEntrypoint bool
+		wantProblems  []string
+	}{
+		{
+			name: "compatible",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "oputs", ioParams, nil)
+				tm.importFunc("wasi_snapshot_preview1", "proc_exit", []api.ValueType{i32}, nil)
+			},
+		},
+		{
+			name: "buffer based host functions need no allocator",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "ireadbody", ioParams, []api.ValueType{i32})
+			},
+		},
+		{
+			name: "allocator",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "igets", nil, []api.ValueType{i64})
+				stubAllocator(tm)
+			},
+		},
+		{
+			name: "missing allocator",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "igets", nil, []api.ValueType{i64})
+			},
+			wantProblems: []string{`missing export "malloc" (i32) -> (i32)`, `missing export "free" (i32) -> ()`},
+		},
+		{
+			name: "bad allocator signature",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "igetbody", nil, []api.ValueType{i64})
+				tm.exportFunc("malloc", tm.function([]api.ValueType{i64}, []api.ValueType{i64}, nil, opI64Const(0)))
+				tm.exportFunc("free", tm.function([]api.ValueType{i32}, nil, nil))
+			},
+			wantProblems: []string{`exports "malloc" as (i64) -> (i64), but host expects (i32) -> (i32)`},
+		},
+		{
+			name: "bad entrypoint signature",
+			build: func(tm *testModule) {
+				tm.exportFunc(runFnName, tm.function([]api.ValueType{i32}, nil, nil))
+			},
+			ownEntrypoint: true,
+			wantProblems:  []string{`exports "run" as (i32) -> (), but host expects () -> ()`},
+		},
+		{
+			name:          "missing entrypoint",
+			build:         func(tm *testModule) {},
+			ownEntrypoint: true,
+			wantProblems:  []string{`missing export "run" () -> ()`},
+		},
+		{
+			name: "bad import signature",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32}, nil)
+			},
+			wantProblems: []string{"imports httpwasm.oputs as (i32) -> (), but host provides (i32, i32) -> ()"},
+		},
+		{
+			name: "unknown imports",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "iwhatever", nil, nil)
+				tm.importFunc("env", "abort", nil, nil)
+			},
+			wantProblems: []string{
+				"imports httpwasm.iwhatever: function not provided by the host",
+				`imports env.abort: unknown host module "env"`,
+			},
+		},
+		{
+			name: "not granted",
+			build: func(tm *testModule) {
+				tm.importFunc(hostModuleName, "ijsonget", []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i64})
+			},
+			wantProblems: []string{"imports httpwasm.ijsonget: capability not granted"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tm testModule
+			tt.build(&tm)
+			if !tt.ownEntrypoint {
+				tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+			}
+			guest, wasi, host := compileTestModules(t, tm.bytes())
+			grants, err := newCapabilityGrants("test", []string{"io", "body"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = preflightCheck(guest, runFnName, grants, wasi, host)
+			if len(tt.wantProblems) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var pe *preflightError
+			if !errors.As(err, &pe) {
+				t.Fatalf("got error %v, want a preflight one", err)
+			}
+			// all the problems at once
+			if len(pe.problems) != len(tt.wantProblems) {
+				t.Fatalf("got problems %q, want %q", pe.problems, tt.wantProblems)
+			}
+			for _, want := range tt.wantProblems {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("got problems %q, want one about %q", pe.problems, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNeedsAllocator(t *testing.T) {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	tests := []struct {
+		module string
+		fn     string
+		params []api.ValueType
+		result []api.ValueType
+		want   bool
+	}{
+		{module: hostModuleName, fn: "igets", result: []api.ValueType{i64}, want: true},
+		{module: hostModuleName, fn: "igetbody", result: []api.ValueType{i64}, want: true},
+		{module: hostModuleName, fn: "igetenv", result: []api.ValueType{i64}, want: true},
+		{module: hostModuleName, fn: "ireadbody", params: []api.ValueType{i32, i32}, result: []api.ValueType{i32}},
+		{module: hostModuleName, fn: "oputs", params: []api.ValueType{i32, i32}},
+		// only the host module functions allocate
+		{module: "env", fn: "igets", result: []api.ValueType{i64}},
+	}
+	for _, tt := range tests {
+		var tm testModule
+		tm.importFunc(tt.module, tt.fn, tt.params, tt.result)
+		guest, _, _ := compileTestModules(t, tm.bytes())
+		if got := needsAllocator(guest); got != tt.want {
+			t.Errorf("%s.%s: got %v, want %v", tt.module, tt.fn, got, tt.want)
+		}
+	}
+}
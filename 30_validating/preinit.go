@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// the functions the runtime calls to initialize commands and reactors:
+// the pre-initialized module must not run them again
+var initExports = []string{commandStartFn, reactorInitFn}
+
+var errPreinitUnsupported = errors.New("module not supported for pre-initialization")
+
+// preinitialize runs the module initialization, then the initFn export,
+// if given, and bakes the resulting state into a new binary: the memory
+// becomes the data segments, the mutable globals get their current
+// values as initializers. The initialization functions are not exported
+// anymore, so the runtime won't run them again.
+// Anything outside the module state, like open files, is lost: the
+// initialization must not depend on it. The module configuration, if
+// the initialization reads it, is baked too.
+func preinitialize(ctx context.Context, wasmObj []byte, initFn string, config []byte) ([]byte, error) {
+	var ts time.Time
+
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCustomSections(true))
+	defer rt.Close(ctx)
+
+	ts = time.Now()
+	code, err := rt.CompileModule(ctx, wasmObj)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readGuestMeta(code)
+	if err != nil {
+		return nil, err
+	}
+	abi, err := negotiateABI(meta)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := detectModuleKind(code)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		return nil, err
+	}
+	if _, err := newHostModuleBuilder(rt, abi).Instantiate(ctx); err != nil {
+		return nil, err
+	}
+	// like when the host runs it, the initialization can read the
+	// configuration and log, but gets no request data
+	grants, err := newCapabilityGrants("preinit", []string{"io", "config"})
+	if err != nil {
+		return nil, err
+	}
+	limits, err := limitsSettings{}.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	cdata := &callData{
+		stdout:    limitedBuffer{name: "stdout", limit: limits.Stdout},
+		stderr:    limitedBuffer{name: "stderr", limit: limits.Stderr},
+		delimiter: abi.delimiter,
+		grants:    grants,
+		config:    config,
+	}
+	ctx = context.WithValue(ctx, callDataKey{}, cdata)
+	defer func() {
+		if cdata.stderr.Len() > 0 {
+			log.Printf("module stderr: [%s]", cdata.stderr.Bytes())
+		}
+	}()
+
+	mod, err := rt.InstantiateModule(ctx, code, withModuleKind(wazero.NewModuleConfig(), kind))
+	if err != nil {
+		return nil, fmt.Errorf("initialization: %w", err)
+	}
+	if mod.IsClosed() {
+		return nil, fmt.Errorf("%w: %w", errPreinitUnsupported, errCommandExited)
+	}
+	if initFn != "" {
+		fn := mod.ExportedFunction(initFn)
+		if fn == nil {
+			return nil, fmt.Errorf("failed to lookup function %q", initFn)
+		}
+		if _, err := fn.Call(ctx); err != nil {
+			return nil, fmt.Errorf("%s: %w", initFn, err)
+		}
+	}
+	log.Printf("module (%s) initialized in %v", kind, time.Since(ts))
+
+	ts = time.Now()
+	out, err := bakeState(wasmObj, mod)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("module state baked in %v", time.Since(ts))
+
+	ts = time.Now()
+	valRT := wazero.NewRuntime(ctx)
+	defer valRT.Close(ctx)
+	if _, err := valRT.CompileModule(ctx, out); err != nil {
+		return nil, fmt.Errorf("pre-initialized module is invalid: %w", err)
+	}
+	log.Printf("pre-initialized module validated in %v", time.Since(ts))
+	return out, nil
+}
+
+// bakeState rewrites the binary with the state of the module instance.
+func bakeState(wasmObj []byte, mod api.Module) ([]byte, error) {
+	im, ok := mod.(experimental.InternalModule)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot read globals", errPreinitUnsupported)
+	}
+	sections, err := parseWasmSections(wasmObj)
+	if err != nil {
+		return nil, err
+	}
+
+	var memory []byte
+	if mem := guestMemory(mod); mem != nil {
+		memory, _ = mem.Read(0, mem.Size())
+	}
+	dataSegments := appendMemorySegments(nil, memory)
+
+	importedGlobals := 0
+	var out []wasmSection
+	for _, sec := range sections {
+		switch sec.id {
+		case wasmSectionImport:
+			var imports importCounts
+			imports, err = countImports(sec.payload)
+			if err == nil && imports.memories > 0 {
+				err = fmt.Errorf("%w: imported memory", errPreinitUnsupported)
+			}
+			importedGlobals = imports.globals
+		case wasmSectionMemory:
+			sec.payload, err = bakeMemorySection(sec.payload, uint32(len(memory)/wasmPageSize))
+		case wasmSectionGlobal:
+			sec.payload, err = bakeGlobalSection(sec.payload, im, importedGlobals)
+		case wasmSectionExport:
+			sec.payload, err = removeExports(sec.payload, initExports)
+		case wasmSectionStart:
+			continue // already run
+		case wasmSectionDataCount:
+			if err = checkNoPassiveData(sections); err == nil {
+				count, _ := vecCount(dataSegments)
+				sec.payload = binary.AppendUvarint(nil, uint64(count))
+			}
+		case wasmSectionData:
+			if err = checkNoPassiveData(sections); err == nil {
+				sec.payload = dataSegments
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sec)
+	}
+	if memory != nil && !hasSection(out, wasmSectionData) {
+		out = insertSection(out, wasmSection{id: wasmSectionData, payload: dataSegments})
+	}
+	return encodeWasmSections(out, len(wasmObj)+len(dataSegments)), nil
+}
+
+// bakeMemorySection sets the minimum size of the memory to its current one.
+func bakeMemorySection(payload []byte, pages uint32) ([]byte, error) {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	if count != 1 {
+		return nil, fmt.Errorf("%w: %d memories", errPreinitUnsupported, count)
+	}
+	flags, err := rd.byte()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rd.u32(); err != nil { // min
+		return nil, err
+	}
+	out := binary.AppendUvarint(nil, 1)
+	out = append(out, flags)
+	out = binary.AppendUvarint(out, uint64(pages))
+	return append(out, payload[rd.pos:]...), nil // max, if any
+}
+
+// bakeGlobalSection replaces the initializers of the mutable globals
+// with their current values.
+func bakeGlobalSection(payload []byte, im experimental.InternalModule, importedGlobals int) ([]byte, error) {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	out := binary.AppendUvarint(nil, uint64(count))
+	for i := uint32(0); i < count; i++ {
+		start := rd.pos
+		valType, err := rd.byte()
+		if err != nil {
+			return nil, err
+		}
+		mut, err := rd.byte()
+		if err != nil {
+			return nil, err
+		}
+		if err := rd.skipConstExpr(); err != nil {
+			return nil, err
+		}
+		if mut != 0x01 {
+			out = append(out, payload[start:rd.pos]...)
+			continue
+		}
+		switch valType {
+		case api.ValueTypeI32, api.ValueTypeI64, api.ValueTypeF32, api.ValueTypeF64:
+		default:
+			return nil, fmt.Errorf("%w: mutable global %d of type %#x", errPreinitUnsupported, i, valType)
+		}
+		out = append(out, valType, mut)
+		out = appendConstExpr(out, valType, im.Global(importedGlobals+int(i)).Get())
+	}
+	return out, nil
+}
+
+// removeExports drops the exports with the given names.
+func removeExports(payload []byte, names []string) ([]byte, error) {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	var entries []byte
+	kept := 0
+	for i := uint32(0); i < count; i++ {
+		start := rd.pos
+		name, err := rd.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rd.byte(); err != nil { // kind
+			return nil, err
+		}
+		if _, err := rd.u32(); err != nil { // index
+			return nil, err
+		}
+		if slices.Contains(names, string(name)) {
+			continue
+		}
+		entries = append(entries, payload[start:rd.pos]...)
+		kept++
+	}
+	return append(binary.AppendUvarint(nil, uint64(kept)), entries...), nil
+}
+
+// checkNoPassiveData rejects modules with passive data segments: code
+// may refer to them by index, and we replace all the segments.
+func checkNoPassiveData(sections []wasmSection) error {
+	for _, sec := range sections {
+		if sec.id != wasmSectionData {
+			continue
+		}
+		rd := wasmReader{data: sec.payload}
+		count, err := rd.u32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < count; i++ {
+			flags, err := rd.u32()
+			if err != nil {
+				return err
+			}
+			switch flags {
+			case 0: // active, memory 0
+			case 2: // active, explicit memory
+				_, err = rd.u32()
+			default:
+				return fmt.Errorf("%w: passive data segment %d", errPreinitUnsupported, i)
+			}
+			if err == nil {
+				err = rd.skipConstExpr()
+			}
+			if err == nil {
+				_, err = rd.bytes()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasSection(sections []wasmSection, id byte) bool {
+	for _, sec := range sections {
+		if sec.id == id {
+			return true
+		}
+	}
+	return false
+}
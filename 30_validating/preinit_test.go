@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// initModule builds a reactor whose initialization stores 42 in the
+// global and at address 16, and whose "setup" export stores 7 at
+// address 2*wasmPageSize, growing the memory to reach it.
+func initModule() []byte {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	tm.memoryPages(1)
+	tm.dataAt(0, []byte("kept"))
+	counter := tm.global(i32, true, 0)
+	tm.global(api.ValueTypeI64, false, -5)
+	initialize := tm.function(nil, nil, nil,
+		opI32Const(42), opGlobalSet(counter),
+		opI32Const(16), opI32Const(42), opI32Store(),
+	)
+	setup := tm.function(nil, nil, nil,
+		opI32Const(2), []byte{0x40, 0x00, 0x1a}, // memory.grow, drop
+		opI32Const(2*wasmPageSize), opI32Const(7), opI32Store(),
+	)
+	tm.exportFunc(reactorInitFn, initialize)
+	tm.exportFunc("setup", setup)
+	tm.exportGlobal("counter", counter)
+	return tm.bytes()
+}
+
+func instantiateBaked(t *testing.T, wasmObj []byte) api.Module {
+	t.Helper()
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	t.Cleanup(func() { rt.Close(ctx) })
+	// no start functions: whatever still runs them would fail the test
+	mod, err := rt.InstantiateWithConfig(ctx, wasmObj, wazero.NewModuleConfig().WithStartFunctions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mod
+}
+
+func TestPreinitialize(t *testing.T) {
+	ctx := context.Background()
+	for _, initFn := range []string{"", "setup"} {
+		out, err := preinitialize(ctx, initModule(), initFn, nil)
+		if err != nil {
+			t.Fatalf("init function %q: %v", initFn, err)
+		}
+		mod := instantiateBaked(t, out)
+		if mod.ExportedFunction(reactorInitFn) != nil {
+			t.Fatalf("init function %q: %s is still exported", initFn, reactorInitFn)
+		}
+		if mod.ExportedFunction("setup") == nil {
+			t.Fatalf("init function %q: setup is not exported anymore", initFn)
+		}
+		if got := mod.ExportedGlobal("counter").Get(); got != 42 {
+			t.Fatalf("init function %q: got counter %d, want 42", initFn, got)
+		}
+		if got := mod.(experimental.InternalModule).Global(1).Get(); int64(got) != -5 {
+			t.Fatalf("init function %q: got immutable global %d, want -5", initFn, int64(got))
+		}
+		mem := mod.Memory()
+		if kept, _ := mem.Read(0, 4); string(kept) != "kept" {
+			t.Fatalf("init function %q: got data %q, want the original", initFn, kept)
+		}
+		if v, _ := mem.ReadUint32Le(16); v != 42 {
+			t.Fatalf("init function %q: got %d at 16, want 42", initFn, v)
+		}
+
+		wantPages := uint32(1)
+		if initFn != "" {
+			wantPages = 3
+			if v, _ := mem.ReadUint32Le(2 * wasmPageSize); v != 7 {
+				t.Fatalf("init function %q: got %d in the grown memory, want 7", initFn, v)
+			}
+		}
+		if pages := mem.Size() / wasmPageSize; pages != wantPages {
+			t.Fatalf("init function %q: got %d pages, want %d", initFn, pages, wantPages)
+		}
+	}
+}
+
+func TestPreinitializeBakesConfig(t *testing.T) {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	readConfig := tm.importFunc(hostModuleName, "ireadconfig", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	tm.memoryPages(1)
+	initialize := tm.function(nil, nil, nil,
+		opI32Const(0), opI32Const(64), opCall(readConfig),
+		[]byte{0x1a}, // drop
+	)
+	tm.exportFunc(reactorInitFn, initialize)
+
+	out, err := preinitialize(context.Background(), tm.bytes(), "", []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the baked module still imports the host functions
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	if _, err := newHostModuleBuilder(rt, hostABIs[hostABILegacy]).Instantiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := rt.InstantiateWithConfig(ctx, out, wazero.NewModuleConfig().WithStartFunctions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mod.Memory().Read(0, 7); string(got) != `{"a":1}` {
+		t.Fatalf("got config %q in memory", got)
+	}
+}
+
+func TestPreinitializeRejectsUnsupported(t *testing.T) {
+	i32 := api.ValueTypeI32
+
+	var passive testModule
+	passive.memoryPages(1)
+	passive.data = append(passive.data, []byte{0x01, 0x02, 'h', 'i'})
+
+	var command testModule
+	exit := command.importFunc("wasi_snapshot_preview1", "proc_exit", []api.ValueType{i32}, nil)
+	command.memoryPages(1)
+	start := command.function(nil, nil, nil, opI32Const(0), opCall(exit))
+	command.exportFunc(commandStartFn, start)
+
+	var externref testModule
+	externref.globals = append(externref.globals, []byte{api.ValueTypeExternref, 0x01, 0xd0, api.ValueTypeExternref, 0x0b})
+
+	tests := map[string][]byte{
+		"passive data":      passive.bytes(),
+		"exiting command":   command.bytes(),
+		"reference globals": externref.bytes(),
+	}
+	for name, wasmObj := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := preinitialize(context.Background(), wasmObj, "", nil); !errors.Is(err, errPreinitUnsupported) {
+				t.Fatalf("got error %v, want %v", err, errPreinitUnsupported)
+			}
+		})
+	}
+}
+
+func TestBakeMemorySectionKeepsMaximum(t *testing.T) {
+	payload := []byte{0x01, 0x01, 0x01, 0x10} // one memory, min 1, max 16
+	out, err := bakeMemorySection(payload, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := wasmReader{data: out}
+	count, _ := rd.u32()
+	flags, _ := rd.byte()
+	minPages, _ := rd.u32()
+	maxPages, _ := rd.u32()
+	if count != 1 || flags != 0x01 || minPages != 4 || maxPages != 16 {
+		t.Fatalf("got %d memories, flags %#x, pages %d to %d", count, flags, minPages, maxPages)
+	}
+	if _, err := bakeMemorySection(binary.AppendUvarint(nil, 2), 1); !errors.Is(err, errPreinitUnsupported) {
+		t.Fatalf("two memories: got error %v, want %v", err, errPreinitUnsupported)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const preinitUsage = `usage: httpwasm preinit [-init NAME] [-config FILE] IN.wasm OUT.wasm
+
+Runs the initialization of IN.wasm (_start or _initialize, then the
+NAME export, if given) and writes to OUT.wasm a module which starts
+from the resulting state, skipping the initialization.
+Modules reading their configuration during the initialization get the
+content of FILE, if given: the configuration in the module settings
+is then ignored, since the pre-initialized module never reads it.
+`
+
+func preinitMain(args []string) int {
+	var initFn string
+	var configPath string
+	flags := flag.NewFlagSet("preinit", flag.ExitOnError)
+	flags.StringVar(&initFn, "init", "", "function to call after the module initialization")
+	flags.StringVar(&configPath, "config", "", "file holding the module configuration")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), preinitUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	inPath, outPath := flags.Arg(0), flags.Arg(1)
+
+	var config []byte
+	if configPath != "" {
+		var err error
+		config, err = os.ReadFile(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "preinit: %v\n", err)
+			return 1
+		}
+	}
+	wasmObj, err := os.ReadFile(inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "preinit: %v\n", err)
+		return 1
+	}
+	out, err := preinitialize(context.Background(), wasmObj, initFn, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "preinit: %s: %v\n", inPath, err)
+		return 1
+	}
+	if err := writeFileAtomic(outPath, out); err != nil {
+		fmt.Fprintf(os.Stderr, "preinit: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const (
+	recycleReasonTrap     = "trap"
+	recycleReasonRequests = "requests"
+	recycleReasonMemory   = "memory"
+	recycleReasonRestore  = "restore"
+)
+
+var (
+	// module.reason -> count
+	instanceRecycles = expvar.NewMap("instance_recycles")
+	// module -> count
+	instanceRetries = expvar.NewMap("instance_retries")
+)
+
+// recycleSettings controls when a guest instance is discarded and replaced
+// by a fresh one. This always happens after a trap, since the guest state
+// can't be trusted anymore.
+type recycleSettings struct {
+	// MaxRequests is how many requests an instance serves before being
+	// recycled. Zero means unlimited.
+	MaxRequests int `json:"maxRequests,omitempty"`
+	// MaxMemoryGrowth is how many bytes the linear memory can grow past
+	// its size after instantiation before the instance is recycled.
+	// Zero means unlimited.
+	MaxMemoryGrowth int64 `json:"maxMemoryGrowth,omitempty"`
+	// RetryIdempotent retries once, on the fresh instance, the requests
+	// with idempotent methods which made the guest trap. Only if the
+	// guest wrote no output yet: having got that far, it might well have
+	// acted on the request already, idempotent or not.
+	RetryIdempotent bool `json:"retryIdempotent,omitempty"`
+}
+
+func (rs recycleSettings) validate() error {
+	if rs.MaxRequests < 0 {
+		return fmt.Errorf("recycle: negative max requests %d", rs.MaxRequests)
+	}
+	if rs.MaxMemoryGrowth < 0 {
+		return fmt.Errorf("recycle: negative max memory growth %d", rs.MaxMemoryGrowth)
+	}
+	return nil
+}
+
+// recycleReason tells why the current, healthy, instance should be
+// recycled, if it should.
+func (we *wasmEngine) recycleReason() string {
+	if we.recycle.MaxRequests > 0 && we.requests >= we.recycle.MaxRequests {
+		return recycleReasonRequests
+	}
+	if mem := guestMemory(we.guestMod); mem != nil && we.recycle.MaxMemoryGrowth > 0 {
+		if int64(mem.Size())-int64(we.baseMemory) > we.recycle.MaxMemoryGrowth {
+			return recycleReasonMemory
+		}
+	}
+	return ""
+}
+
+// recycleInstance replaces the guest instance. If that fails, the engine
+// tries again on the next request.
+func (we *wasmEngine) recycleInstance(ctx context.Context, reason string) {
+	log.Printf("module %q: recycling instance after %d requests (%s)", we.name, we.requests, reason)
+	instanceRecycles.Add(we.name+"."+reason, 1)
+	if err := we.instantiate(ctx); err != nil {
+		log.Printf("module %q: cannot recycle instance: %v", we.name, err)
+	}
+}
+
+// shouldRetry tells if the failed call should be retried, see
+// recycleSettings.RetryIdempotent.
+func (we *wasmEngine) shouldRetry(err error, method string, cdata *callData) bool {
+	return we.recycle.RetryIdempotent && isIdempotent(method) && cdata.stdout.Len() == 0 && classifyError(err).Kind == errKindTrap
+}
+
+// isIdempotent tells if the method is idempotent, per RFC 9110.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
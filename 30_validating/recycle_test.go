@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestRecycleReason(t *testing.T) {
+	var tm testModule
+	tm.memoryPages(1)
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+	wasmObj := tm.bytes()
+
+	tests := []struct {
+		name      string
+		recycle   recycleSettings
+		requests  int
+		growPages uint32
+		want      string
+	}{
+		{name: "unlimited", requests: 1000, growPages: 10},
+		{name: "under max requests", recycle: recycleSettings{MaxRequests: 3}, requests: 2},
+		{name: "max requests", recycle: recycleSettings{MaxRequests: 3}, requests: 3, want: recycleReasonRequests},
+		{name: "under max memory growth", recycle: recycleSettings{MaxMemoryGrowth: wasmPageSize}, growPages: 1},
+		{name: "max memory growth", recycle: recycleSettings{MaxMemoryGrowth: wasmPageSize}, growPages: 2, want: recycleReasonMemory},
+		// the requests are checked first
+		{name: "both", recycle: recycleSettings{MaxRequests: 1, MaxMemoryGrowth: 1}, requests: 1, growPages: 1, want: recycleReasonRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := newTestEngine(t, wasmObj, moduleSettings{Recycle: tt.recycle})
+			we.requests = tt.requests
+			if _, ok := we.guestMod.Memory().Grow(tt.growPages); !ok {
+				t.Fatal("cannot grow the memory")
+			}
+			if got := we.recycleReason(); got != tt.want {
+				t.Fatalf("got reason %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineRecyclesInstances(t *testing.T) {
+	var tm testModule
+	tm.memoryPages(1)
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil))
+	we := newTestEngine(t, tm.bytes(), moduleSettings{Recycle: recycleSettings{MaxRequests: 2}})
+
+	var instances []api.Module
+	for range 4 {
+		instances = append(instances, we.guestMod)
+		if err := we.Run(context.Background(), "test", strings.NewReader(""), testRequestEnv, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if instances[0] != instances[1] || instances[1] == instances[2] || instances[2] != instances[3] {
+		t.Fatal("the instance was not recycled every 2 requests")
+	}
+}
+
+func TestEngineRetry(t *testing.T) {
+	i32 := api.ValueTypeI32
+	// trapModule traps, after writing some output if asked to
+	trapModule := func(output bool) []byte {
+		var tm testModule
+		puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+		tm.memoryPages(1)
+		tm.dataAt(0, []byte("partial"))
+		var body [][]byte
+		if output {
+			body = append(body, opI32Const(0), opI32Const(7), opCall(puts))
+		}
+		tm.exportFunc(runFnName, tm.function(nil, nil, nil, append(body, []byte{0x00})...)) // unreachable
+		return tm.bytes()
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		retry       bool
+		output      bool
+		wantRetries int64
+	}{
+		{name: "disabled", method: "GET"},
+		{name: "idempotent", method: "GET", retry: true, wantRetries: 1},
+		{name: "not idempotent", method: "POST", retry: true},
+		// the guest might have acted on the request already
+		{name: "output written", method: "GET", retry: true, output: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := newTestEngine(t, trapModule(tt.output), moduleSettings{Recycle: recycleSettings{RetryIdempotent: tt.retry}})
+			name := "retry " + tt.name // the counters are per module
+			env := map[string]string{"HTTP_METHOD": tt.method}
+			err := we.Run(context.Background(), name, strings.NewReader(""), env, io.Discard)
+			if ge := classifyError(err); ge.Kind != errKindTrap {
+				t.Fatalf("got error %v, want a trap", err)
+			}
+			var retries int64
+			if v, ok := instanceRetries.Get(name).(*expvar.Int); ok {
+				retries = v.Value()
+			}
+			if retries != tt.wantRetries {
+				t.Fatalf("got %d retries, want %d", retries, tt.wantRetries)
+			}
+		})
+	}
+}
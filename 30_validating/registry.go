@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how many previous deployments we keep around, ready to roll back to
+	maxDeploymentHistory = 5
+)
+
+var errNoRollback = errors.New("no previous deployment to roll back to")
+
+// deployment is a module binary compiled and ready to serve requests.
+// Its engine is closed once the slot drops it and the requests it is
+// serving, if any, are done: see acquire and release.
+type deployment struct {
+	engine     *wasmEngine
+	digest     string
+	revision   int
+	deployedAt time.Time
+
+	// the slot holds a reference while the deployment is current or
+	// in the history, each request using it holds another
+	refs atomic.Int64
+}
+
+// acquire takes a reference, unless the deployment is already closed.
+func (dep *deployment) acquire() bool {
+	for {
+		refs := dep.refs.Load()
+		if refs == 0 {
+			return false
+		}
+		if dep.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference, closing the engine with the last one.
+func (dep *deployment) release(ctx context.Context) {
+	if dep.refs.Add(-1) > 0 {
+		return
+	}
+	dep.engine.Close(ctx)
+	log.Printf("module %q: revision %d (%s) closed", dep.engine.name, dep.revision, dep.digest)
+}
+
+// moduleSlot is where a module is served from. Requests always use the
+// current deployment, which can be atomically swapped at runtime.
+type moduleSlot struct {
+	name    string
+	current atomic.Pointer[deployment]
+
+	// shared by all the deployments, so they can't regain revoked grants
+	opts engineOptions
+
+	mu       sync.Mutex // serializes deploy and rollback
+	history  []*deployment
+	revision int
+}
+
+// moduleRegistry holds all the module slots. The set of slots is fixed
+// once the server starts; only their deployments change.
+type moduleRegistry struct {
+	slots map[string]*moduleSlot
+	// modules can mount directories from here, usually the bundle
+	assets fs.FS
+	// nil unless core dumps are enabled
+	coredumps *coredumpWriter
+}
+
+func newModuleRegistry(assets fs.FS) *moduleRegistry {
+	return &moduleRegistry{
+		slots:  make(map[string]*moduleSlot),
+		assets: assets,
+	}
+}
+
+func (mr *moduleRegistry) Slot(name string) (*moduleSlot, bool) {
+	slot, ok := mr.slots[name]
+	return slot, ok
+}
+
+// Register adds a slot for the module, deploying its initial binary.
+// Registering the same module again returns the existing slot.
+func (mr *moduleRegistry) Register(ctx context.Context, name string, wasmObj []byte, settings moduleSettings) (*moduleSlot, error) {
+	if slot, ok := mr.slots[name]; ok {
+		return slot, nil
+	}
+	grants, err := newCapabilityGrants(name, settings.Capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %w", name, err)
+	}
+	sb, err := newSandbox(settings, mr.assets)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %w", name, err)
+	}
+	problems, err := newProblemPolicy(settings.Errors)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %w", name, err)
+	}
+	slot := &moduleSlot{
+		name: name,
+		opts: engineOptions{
+			name:      name,
+			settings:  settings,
+			grants:    grants,
+			sandbox:   sb,
+			problems:  problems,
+			coredumps: mr.coredumps,
+		},
+	}
+	if _, err := slot.Deploy(ctx, wasmObj); err != nil {
+		return nil, err
+	}
+	mr.slots[name] = slot
+	return slot, nil
+}
+
+func (mr *moduleRegistry) Close(ctx context.Context) {
+	for _, slot := range mr.slots {
+		slot.Close(ctx)
+	}
+}
+
+// prepareDeployment is the single path every module binary goes through,
+// at startup or at runtime, before it can serve any request.
+func prepareDeployment(ctx context.Context, wasmObj []byte, opts engineOptions) (*deployment, error) {
+	we, err := newWasmEngine(ctx, wasmObj, opts)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %w", opts.name, err)
+	}
+	dep := &deployment{
+		engine:     we,
+		digest:     digestOf(wasmObj),
+		deployedAt: time.Now(),
+	}
+	dep.refs.Store(1) // the slot's
+	return dep, nil
+}
+
+// Deploy compiles the binary and, only if that succeeds, makes it
+// the current deployment. The previous one is kept for rollback.
+func (ms *moduleSlot) Deploy(ctx context.Context, wasmObj []byte) (*deployment, error) {
+	dep, err := prepareDeployment(ctx, wasmObj, ms.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.revision++
+	dep.revision = ms.revision
+	prev := ms.current.Swap(dep)
+	if prev != nil {
+		ms.history = append(ms.history, prev)
+	}
+	for len(ms.history) > maxDeploymentHistory {
+		expired := ms.history[0]
+		ms.history = ms.history[1:]
+		expired.release(ctx)
+	}
+	log.Printf("module %q: deployed revision %d (%s)", ms.name, dep.revision, dep.digest)
+	return dep, nil
+}
+
+// Rollback restores the previous deployment, discarding the current one.
+func (ms *moduleSlot) Rollback(ctx context.Context) (*deployment, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if len(ms.history) == 0 {
+		return nil, errNoRollback
+	}
+	dep := ms.history[len(ms.history)-1]
+	ms.history = ms.history[:len(ms.history)-1]
+	discarded := ms.current.Swap(dep)
+	log.Printf("module %q: rolled back from revision %d to revision %d (%s)", ms.name, discarded.revision, dep.revision, dep.digest)
+	discarded.release(ctx)
+	return dep, nil
+}
+
+// Acquire returns the current deployment, which stays usable until
+// released, even if it is swapped out meanwhile. Returns nil if the
+// slot is closed.
+func (ms *moduleSlot) Acquire() *deployment {
+	for {
+		dep := ms.current.Load()
+		if dep == nil {
+			return nil
+		}
+		if dep.acquire() {
+			return dep
+		}
+		// swapped out and closed since loaded: there is a new one
+	}
+}
+
+// Release gives back a deployment Acquire returned.
+func (ms *moduleSlot) Release(ctx context.Context, dep *deployment) {
+	dep.release(ctx)
+}
+
+func (ms *moduleSlot) Close(ctx context.Context) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, dep := range ms.history {
+		dep.release(ctx)
+	}
+	ms.history = nil
+	if dep := ms.current.Swap(nil); dep != nil {
+		dep.release(ctx)
+	}
+}
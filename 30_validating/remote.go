@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	remoteNamePlaceholder = "{name}"
+	remoteDefaultMaxSize  = 64 << 20 // 64 MiB
+	remoteDefaultRetries  = 3
+	remoteDefaultBackoff  = 250 * time.Millisecond
+)
+
+var errRemoteTooLarge = errors.New("remote module exceeds max size")
+
+// remoteFS fetches modules from an HTTP(S) origin. The URL is built from a
+// template replacing "{name}" with the module name (without extension).
+// The last good copy of each module is kept on disk, alongside its ETag,
+// to revalidate with If-None-Match and to serve when the origin is down.
+type remoteFS struct {
+	urlTemplate string
+	cacheDir    string
+	maxSize     int64
+	retries     int
+	backoff     time.Duration
+	client      *http.Client
+}
+
+func newRemoteFS(urlTemplate, cacheDir string) *remoteFS {
+	return &remoteFS{
+		urlTemplate: urlTemplate,
+		cacheDir:    cacheDir,
+		maxSize:     remoteDefaultMaxSize,
+		retries:     remoteDefaultRetries,
+		backoff:     remoteDefaultBackoff,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (rf *remoteFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) || strings.Contains(name, "/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	data, err := rf.fetch(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &memFile{
+		Reader: bytes.NewReader(data),
+		name:   name,
+		size:   int64(len(data)),
+	}, nil
+}
+
+// url escapes the module name: fs.ValidPath lets through characters
+// like '?', '#' and '%', which would change the meaning of the URL.
+func (rf *remoteFS) url(name string) string {
+	modName := url.PathEscape(strings.TrimSuffix(name, ".wasm"))
+	return strings.ReplaceAll(rf.urlTemplate, remoteNamePlaceholder, modName)
+}
+
+func (rf *remoteFS) fetch(name string) ([]byte, error) {
+	cached, etag := rf.readCache(name)
+
+	var err error
+	delay := rf.backoff
+	for attempt := 0; attempt <= rf.retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("remote: retrying %q in %v (attempt %d/%d): %v", name, delay, attempt, rf.retries, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var data []byte
+		var retry bool
+		data, retry, err = rf.get(name, etag, cached)
+		if err == nil {
+			return data, nil
+		}
+		if !retry {
+			break
+		}
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if cached != nil {
+		log.Printf("remote: origin unavailable for %q, using cached copy: %v", name, err)
+		return cached, nil
+	}
+	return nil, err
+}
+
+// get performs a single request against the origin. The boolean tells
+// if the failure is transient, hence worth a retry.
+func (rf *remoteFS) get(name, etag string, cached []byte) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, rf.url(name), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if etag != "" && cached != nil {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := rf.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		log.Printf("remote: %q not modified (etag %s)", name, etag)
+		return cached, false, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, fs.ErrNotExist
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, true, fmt.Errorf("origin replied %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("origin replied %s", resp.Status)
+	}
+
+	if resp.ContentLength > rf.maxSize {
+		return nil, false, fmt.Errorf("%w: %d > %d bytes", errRemoteTooLarge, resp.ContentLength, rf.maxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, rf.maxSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+	if int64(len(data)) > rf.maxSize {
+		return nil, false, fmt.Errorf("%w: more than %d bytes", errRemoteTooLarge, rf.maxSize)
+	}
+
+	rf.writeCache(name, data, resp.Header.Get("ETag"))
+	return data, false, nil
+}
+
+func (rf *remoteFS) cachePaths(name string) (string, string) {
+	dataPath := filepath.Join(rf.cacheDir, name)
+	return dataPath, dataPath + ".etag"
+}
+
+func (rf *remoteFS) readCache(name string) ([]byte, string) {
+	if rf.cacheDir == "" {
+		return nil, ""
+	}
+	dataPath, etagPath := rf.cachePaths(name)
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, ""
+	}
+	etag, err := os.ReadFile(etagPath)
+	if err != nil {
+		return data, ""
+	}
+	return data, string(etag)
+}
+
+// writeCache is best effort: a failure here should not fail the load.
+func (rf *remoteFS) writeCache(name string, data []byte, etag string) {
+	if rf.cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(rf.cacheDir, 0o755); err != nil {
+		log.Printf("remote: cannot create cache dir %q: %v", rf.cacheDir, err)
+		return
+	}
+	dataPath, etagPath := rf.cachePaths(name)
+	if err := writeFileAtomic(dataPath, data); err != nil {
+		log.Printf("remote: cannot cache %q: %v", name, err)
+		return
+	}
+	if etag == "" {
+		os.Remove(etagPath)
+		return
+	}
+	if err := writeFileAtomic(etagPath, []byte(etag)); err != nil {
+		log.Printf("remote: cannot cache etag for %q: %v", name, err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// memFile is a fs.File backed by an in-memory buffer.
+type memFile struct {
+	*bytes.Reader
+	name string
+	size int64
+}
+
+func (mf *memFile) Stat() (fs.FileInfo, error) { return mf, nil }
+func (mf *memFile) Close() error               { return nil }
+
+func (mf *memFile) Name() string       { return mf.name }
+func (mf *memFile) Size() int64        { return mf.size }
+func (mf *memFile) Mode() fs.FileMode  { return 0o444 }
+func (mf *memFile) ModTime() time.Time { return time.Time{} }
+func (mf *memFile) IsDir() bool        { return false }
+func (mf *memFile) Sys() any           { return nil }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRemoteModule = []byte("\x00asm\x01\x00\x00\x00")
+
+// newTestRemote returns a remoteFS fetching from the handler, retrying
+// right away, and counting the requests.
+func newTestRemote(t *testing.T, handler http.HandlerFunc) (*remoteFS, *httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	rf := newRemoteFS(srv.URL+"/modules/{name}.wasm", t.TempDir())
+	rf.backoff = time.Millisecond
+	return rf, srv, &requests
+}
+
+func serveModule(etag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/modules/test.wasm" {
+			http.NotFound(w, r)
+			return
+		}
+		if etag != "" {
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		}
+		w.Write(testRemoteModule)
+	}
+}
+
+func TestRemoteRevalidatesWithETag(t *testing.T) {
+	var revalidated atomic.Int32
+	rf, _, requests := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			revalidated.Add(1)
+		}
+		serveModule(`"v1"`)(w, r)
+	})
+
+	for i := 0; i < 2; i++ {
+		data, err := fs.ReadFile(rf, "test.wasm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testRemoteModule) {
+			t.Fatalf("got %q, want %q", data, testRemoteModule)
+		}
+	}
+	if requests.Load() != 2 || revalidated.Load() != 1 {
+		t.Fatalf("got %d requests, %d revalidations, want 2 and 1", requests.Load(), revalidated.Load())
+	}
+}
+
+func TestRemoteRetriesTransientErrors(t *testing.T) {
+	var failures atomic.Int32
+	rf, _, requests := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		serveModule("")(w, r)
+	})
+
+	data, err := fs.ReadFile(rf, "test.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testRemoteModule) {
+		t.Fatalf("got %q, want %q", data, testRemoteModule)
+	}
+	if requests.Load() != 3 {
+		t.Fatalf("got %d requests, want 3", requests.Load())
+	}
+}
+
+func TestRemoteGivesUpAfterRetries(t *testing.T) {
+	rf, _, requests := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+
+	if _, err := fs.ReadFile(rf, "test.wasm"); err == nil {
+		t.Fatal("fetch succeeded, want an error")
+	}
+	if int(requests.Load()) != rf.retries+1 {
+		t.Fatalf("got %d requests, want %d", requests.Load(), rf.retries+1)
+	}
+}
+
+func TestRemoteMaxSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "declared",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(bytes.Repeat([]byte("x"), 1024))
+			},
+		},
+		{
+			// no Content-Length: the size is only known reading the body
+			name: "streamed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 4; i++ {
+					w.Write(bytes.Repeat([]byte("x"), 256))
+					w.(http.Flusher).Flush()
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rf, _, requests := newTestRemote(t, tt.handler)
+			rf.maxSize = 1000
+
+			_, err := fs.ReadFile(rf, "test.wasm")
+			if !errors.Is(err, errRemoteTooLarge) {
+				t.Fatalf("got error %v, want %v", err, errRemoteTooLarge)
+			}
+			if requests.Load() != 1 {
+				t.Fatalf("got %d requests, want no retries", requests.Load())
+			}
+		})
+	}
+}
+
+func TestRemoteFallsBackToCache(t *testing.T) {
+	var broken atomic.Bool
+	rf, srv, _ := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		if broken.Load() {
+			http.Error(w, "broken", http.StatusBadGateway)
+			return
+		}
+		serveModule(`"v1"`)(w, r)
+	})
+	if _, err := fs.ReadFile(rf, "test.wasm"); err != nil {
+		t.Fatal(err)
+	}
+
+	broken.Store(true)
+	data, err := fs.ReadFile(rf, "test.wasm")
+	if err != nil {
+		t.Fatalf("origin failing: %v", err)
+	}
+	if !bytes.Equal(data, testRemoteModule) {
+		t.Fatalf("origin failing: got %q, want the cached copy", data)
+	}
+
+	srv.Close()
+	data, err = fs.ReadFile(rf, "test.wasm")
+	if err != nil {
+		t.Fatalf("origin down: %v", err)
+	}
+	if !bytes.Equal(data, testRemoteModule) {
+		t.Fatalf("origin down: got %q, want the cached copy", data)
+	}
+}
+
+// a module removed from the origin must not be served from the cache
+func TestRemoteNotFoundSkipsCache(t *testing.T) {
+	var removed atomic.Bool
+	rf, _, _ := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		if removed.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		serveModule("")(w, r)
+	})
+	if _, err := fs.ReadFile(rf, "test.wasm"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed.Store(true)
+	if _, err := fs.ReadFile(rf, "test.wasm"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got error %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestRemoteRejectsPaths(t *testing.T) {
+	rf, _, requests := newTestRemote(t, serveModule(""))
+	for _, name := range []string{"../test.wasm", "dir/test.wasm", "/test.wasm"} {
+		if _, err := rf.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%q: got error %v, want %v", name, err, fs.ErrInvalid)
+		}
+	}
+	if requests.Load() != 0 {
+		t.Fatalf("got %d requests, want none", requests.Load())
+	}
+}
+
+func TestRemoteEscapesNames(t *testing.T) {
+	var path, query atomic.Value
+	rf, _, _ := newTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		path.Store(r.URL.Path)
+		query.Store(r.URL.RawQuery)
+		w.Write(testRemoteModule)
+	})
+	if _, err := fs.ReadFile(rf, "a?b=c#d %25.wasm"); err != nil {
+		t.Fatal(err)
+	}
+	if path.Load() != "/modules/a?b=c#d %25.wasm" || query.Load() != "" {
+		t.Fatalf("got path %q, query %q", path.Load(), query.Load())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+)
+
+const (
+	bundleMountPrefix = "bundle:"
+
+	stdinPolicyNone    = "none"
+	stdinPolicyInherit = "inherit"
+)
+
+// mountSettings exposes a host directory to the guest. Mounts are
+// read-only unless explicitly requested otherwise.
+type mountSettings struct {
+	// HostPath is a directory on the host, or "bundle:<dir>"
+	// for a directory inside the module bundle.
+	HostPath  string `json:"hostPath"`
+	GuestPath string `json:"guestPath"`
+	ReadWrite bool   `json:"readWrite,omitempty"`
+}
+
+// sandbox is what the guest can see of the WASI world. The zero value
+// denies everything: no filesystem, no args, no environment, no stdin.
+type sandbox struct {
+	fsConfig wazero.FSConfig
+	args     []string
+	env      map[string]string
+	stdin    string
+}
+
+func newSandbox(settings moduleSettings, assets fs.FS) (*sandbox, error) {
+	sb := sandbox{
+		args:  settings.Args,
+		env:   settings.Env,
+		stdin: settings.Stdin,
+	}
+	if sb.stdin == "" {
+		sb.stdin = stdinPolicyNone
+	}
+	if sb.stdin != stdinPolicyNone && sb.stdin != stdinPolicyInherit {
+		return nil, fmt.Errorf("unknown stdin policy %q", sb.stdin)
+	}
+
+	if len(settings.Mounts) == 0 {
+		return &sb, nil
+	}
+	sb.fsConfig = wazero.NewFSConfig()
+	guestPaths := make(map[string]bool)
+	for _, mnt := range settings.Mounts {
+		if !path.IsAbs(mnt.GuestPath) {
+			return nil, fmt.Errorf("mount %q: guest path must be absolute", mnt.GuestPath)
+		}
+		if guestPaths[mnt.GuestPath] {
+			return nil, fmt.Errorf("mount %q: duplicate guest path", mnt.GuestPath)
+		}
+		guestPaths[mnt.GuestPath] = true
+
+		if dir, ok := strings.CutPrefix(mnt.HostPath, bundleMountPrefix); ok {
+			if mnt.ReadWrite {
+				return nil, fmt.Errorf("mount %q: bundle contents can only be mounted read-only", mnt.GuestPath)
+			}
+			if assets == nil {
+				return nil, fmt.Errorf("mount %q: no bundle to mount from", mnt.GuestPath)
+			}
+			sub, err := fs.Sub(assets, path.Clean(dir))
+			if err != nil {
+				return nil, fmt.Errorf("mount %q: %w", mnt.GuestPath, err)
+			}
+			sb.fsConfig = sb.fsConfig.WithFSMount(sub, mnt.GuestPath)
+			continue
+		}
+
+		st, err := os.Stat(mnt.HostPath)
+		if err != nil {
+			return nil, fmt.Errorf("mount %q: %w", mnt.GuestPath, err)
+		}
+		if !st.IsDir() {
+			return nil, fmt.Errorf("mount %q: %q is not a directory", mnt.GuestPath, mnt.HostPath)
+		}
+		if mnt.ReadWrite {
+			sb.fsConfig = sb.fsConfig.WithDirMount(mnt.HostPath, mnt.GuestPath)
+		} else {
+			sb.fsConfig = sb.fsConfig.WithReadOnlyDirMount(mnt.HostPath, mnt.GuestPath)
+		}
+	}
+	return &sb, nil
+}
+
+// moduleConfig returns the guest module configuration, applying the sandbox.
+// Guests get the real clocks and a cryptographically secure random source.
+func (sb *sandbox) moduleConfig(name string) wazero.ModuleConfig {
+	config := wazero.NewModuleConfig().
+		WithName(name).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader)
+	if sb.fsConfig != nil {
+		config = config.WithFSConfig(sb.fsConfig)
+	}
+	if len(sb.args) > 0 {
+		config = config.WithArgs(sb.args...)
+	}
+	for key, val := range sb.env {
+		config = config.WithEnv(key, val)
+	}
+	if sb.stdin == stdinPolicyInherit {
+		config = config.WithStdin(os.Stdin)
+	}
+	return config
+}
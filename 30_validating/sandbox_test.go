@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestNewSandbox(t *testing.T) {
+	hostDir := t.TempDir()
+	hostFile := filepath.Join(hostDir, "file")
+	if err := os.WriteFile(hostFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	assets := fstest.MapFS{"static/index.html": {Data: []byte("hello")}}
+
+	tests := []struct {
+		name     string
+		settings moduleSettings
+		assets   fs.FS
+		wantErr  string
+	}{
+		{name: "defaults"},
+		{name: "stdin none", settings: moduleSettings{Stdin: stdinPolicyNone}},
+		{name: "stdin inherit", settings: moduleSettings{Stdin: stdinPolicyInherit}},
+		{name: "unknown stdin policy", settings: moduleSettings{Stdin: "pipe"}, wantErr: `unknown stdin policy "pipe"`},
+		{name: "host mount", settings: moduleSettings{Mounts: []mountSettings{{HostPath: hostDir, GuestPath: "/data"}}}},
+		{name: "read-write host mount", settings: moduleSettings{Mounts: []mountSettings{{HostPath: hostDir, GuestPath: "/data", ReadWrite: true}}}},
+		{name: "bundle mount", settings: moduleSettings{Mounts: []mountSettings{{HostPath: "bundle:static", GuestPath: "/static"}}}, assets: assets},
+		{
+			name:     "relative guest path",
+			settings: moduleSettings{Mounts: []mountSettings{{HostPath: hostDir, GuestPath: "data"}}},
+			wantErr:  "guest path must be absolute",
+		},
+		{
+			name: "duplicate guest path",
+			settings: moduleSettings{Mounts: []mountSettings{
+				{HostPath: hostDir, GuestPath: "/data"},
+				{HostPath: hostDir, GuestPath: "/data"},
+			}},
+			wantErr: "duplicate guest path",
+		},
+		{
+			name:     "missing host directory",
+			settings: moduleSettings{Mounts: []mountSettings{{HostPath: filepath.Join(hostDir, "missing"), GuestPath: "/data"}}},
+			wantErr:  "no such file or directory",
+		},
+		{
+			name:     "host file",
+			settings: moduleSettings{Mounts: []mountSettings{{HostPath: hostFile, GuestPath: "/data"}}},
+			wantErr:  "is not a directory",
+		},
+		{
+			name:     "read-write bundle mount",
+			settings: moduleSettings{Mounts: []mountSettings{{HostPath: "bundle:static", GuestPath: "/static", ReadWrite: true}}},
+			assets:   assets,
+			wantErr:  "can only be mounted read-only",
+		},
+		{
+			name:     "bundle mount without a bundle",
+			settings: moduleSettings{Mounts: []mountSettings{{HostPath: "bundle:static", GuestPath: "/static"}}},
+			wantErr:  "no bundle to mount from",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSandbox(tt.settings, tt.assets)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// sandboxView is what a guest sees of the WASI world.
+type sandboxView struct {
+	argc, argvSize uint32
+	envc, envSize  uint32
+	// the WASI errno of the lookup of the first preopen, and the length
+	// of its name
+	preopenErrno, preopenNameLen uint32
+	stdin                        string
+}
+
+// sandboxModule builds a guest writing out its sandboxView.
+func sandboxModule() []byte {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	argsSizes := tm.importFunc("wasi_snapshot_preview1", "args_sizes_get", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	environSizes := tm.importFunc("wasi_snapshot_preview1", "environ_sizes_get", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	prestatGet := tm.importFunc("wasi_snapshot_preview1", "fd_prestat_get", []api.ValueType{i32, i32}, []api.ValueType{i32})
+	fdRead := tm.importFunc("wasi_snapshot_preview1", "fd_read", []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32})
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	// 0: argc, argv size, envc, env size; 16: fd_prestat_get errno,
+	// 20: prestat; 28: fd_read errno, 32: bytes read; 40: iovec; 64: buffer
+	run := tm.function(nil, nil, nil,
+		opI32Const(0), opI32Const(4), opCall(argsSizes), []byte{0x1a}, // drop
+		opI32Const(8), opI32Const(12), opCall(environSizes), []byte{0x1a},
+		opI32Const(16), opI32Const(3), opI32Const(20), opCall(prestatGet), opI32Store(),
+		opI32Const(40), opI32Const(64), opI32Store(),
+		opI32Const(44), opI32Const(16), opI32Store(),
+		opI32Const(28), opI32Const(0), opI32Const(40), opI32Const(1), opI32Const(32), opCall(fdRead), opI32Store(),
+		opI32Const(0), opI32Const(80), opCall(puts),
+	)
+	tm.exportFunc(runFnName, run)
+	return tm.bytes()
+}
+
+func decodeSandboxView(out []byte) sandboxView {
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(out[off:]) }
+	return sandboxView{
+		argc:           u32(0),
+		argvSize:       u32(4),
+		envc:           u32(8),
+		envSize:        u32(12),
+		preopenErrno:   u32(16),
+		preopenNameLen: u32(24),
+		stdin:          string(out[64 : 64+u32(32)]),
+	}
+}
+
+const (
+	wasiErrnoSuccess = 0
+	wasiErrnoBadf    = 8
+)
+
+func TestSandboxPolicies(t *testing.T) {
+	// the inherited stdin is read when the guest is instantiated
+	stdin, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	savedStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = savedStdin })
+
+	tests := []struct {
+		name     string
+		settings moduleSettings
+		want     sandboxView
+	}{
+		// the zero value denies everything
+		{name: "defaults", want: sandboxView{preopenErrno: wasiErrnoBadf}},
+		{name: "args", settings: moduleSettings{Args: []string{"validate", "-v"}}, want: sandboxView{argc: 2, argvSize: 12, preopenErrno: wasiErrnoBadf}},
+		{name: "env", settings: moduleSettings{Env: map[string]string{"LEVEL": "debug"}}, want: sandboxView{envc: 1, envSize: 12, preopenErrno: wasiErrnoBadf}},
+		{
+			name:     "mount",
+			settings: moduleSettings{Mounts: []mountSettings{{HostPath: t.TempDir(), GuestPath: "/data"}}},
+			want:     sandboxView{preopenErrno: wasiErrnoSuccess, preopenNameLen: 5},
+		},
+		{name: "stdin none", settings: moduleSettings{Stdin: stdinPolicyNone}, want: sandboxView{preopenErrno: wasiErrnoBadf}},
+		{name: "stdin inherit", settings: moduleSettings{Stdin: stdinPolicyInherit}, want: sandboxView{preopenErrno: wasiErrnoBadf, stdin: "hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := newTestEngine(t, sandboxModule(), tt.settings)
+			if got := decodeSandboxView(runOutput(t, we, "")); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// the rewritten module exports each mutable global with this prefix
+// followed by its index, so the host can save and restore them
+const snapshotGlobalPrefix = "httpwasm.global."
+
+// exportMutableGlobals rewrites the binary so that all the mutable
+// globals it defines are exported, and returns their export names.
+// wazero only lets the host write exported globals.
+// Imported globals belong to other modules and are left alone.
+func exportMutableGlobals(wasmObj []byte) ([]byte, []string, error) {
+	sections, err := parseWasmSections(wasmObj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	importedGlobals := 0
+	var mutable []uint32
+	for _, sec := range sections {
+		switch sec.id {
+		case wasmSectionImport:
+			var imports importCounts
+			imports, err = countImports(sec.payload)
+			importedGlobals = imports.globals
+		case wasmSectionGlobal:
+			mutable, err = findMutableGlobals(sec.payload)
+		case wasmSectionExport:
+			_, err = vecCount(sec.payload) // make sure we can append
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var names []string
+	for _, idx := range mutable {
+		globalIdx := uint32(importedGlobals) + idx
+		name := snapshotGlobalPrefix + strconv.FormatUint(uint64(globalIdx), 10)
+
+		var entry []byte
+		entry = appendName(entry, name)
+		entry = append(entry, 0x03) // global
+		entry = binary.AppendUvarint(entry, uint64(globalIdx))
+		sections = appendToVecSection(sections, wasmSectionExport, entry)
+		names = append(names, name)
+	}
+	return encodeWasmSections(sections, len(wasmObj)), names, nil
+}
+
+// findMutableGlobals returns the indexes, in the global section,
+// of the mutable globals.
+func findMutableGlobals(payload []byte) ([]uint32, error) {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return nil, err
+	}
+	var mutable []uint32
+	for i := uint32(0); i < count; i++ {
+		if _, err := rd.byte(); err != nil { // value type
+			return nil, err
+		}
+		mut, err := rd.byte()
+		if err != nil {
+			return nil, err
+		}
+		if mut == 0x01 {
+			mutable = append(mutable, i)
+		}
+		if err := rd.skipConstExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return mutable, nil
+}
+
+// memorySnapshot is the guest state right after initialization: the
+// linear memory and the mutable globals.
+type memorySnapshot struct {
+	memory  []byte
+	globals []api.MutableGlobal
+	values  []uint64
+}
+
+func takeSnapshot(mod api.Module, globalNames []string) (*memorySnapshot, error) {
+	var snap memorySnapshot
+	if mem := guestMemory(mod); mem != nil {
+		data, ok := mem.Read(0, mem.Size())
+		if !ok {
+			return nil, fmt.Errorf("cannot read the guest memory")
+		}
+		snap.memory = append([]byte(nil), data...)
+	}
+	for _, name := range globalNames {
+		global, ok := mod.ExportedGlobal(name).(api.MutableGlobal)
+		if !ok {
+			return nil, fmt.Errorf("failed to lookup global %q", name)
+		}
+		snap.globals = append(snap.globals, global)
+		snap.values = append(snap.values, global.Get())
+	}
+	return &snap, nil
+}
+
+// restore brings the guest back to the snapshot. The memory can't shrink:
+// if it grew, the pages added are zeroed, so no data survives anyway.
+func (snap *memorySnapshot) restore(mod api.Module) error {
+	if mem := guestMemory(mod); mem != nil {
+		data, ok := mem.Read(0, mem.Size())
+		if !ok || len(data) < len(snap.memory) {
+			return fmt.Errorf("cannot restore the guest memory")
+		}
+		copy(data, snap.memory)
+		clear(data[len(snap.memory):])
+	}
+	for i, global := range snap.globals {
+		global.Set(snap.values[i])
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestExportMutableGlobals(t *testing.T) {
+	ctx := context.Background()
+	i32 := api.ValueTypeI32
+
+	// the module providing the imported global
+	var env testModule
+	env.exportGlobal("g", env.global(i32, true, 1))
+
+	var tm testModule
+	tm.importGlobal("env", "g", i32, true)
+	// the values are ten times the indices
+	tm.global(i32, false, 10)
+	second := tm.global(i32, true, 20)
+	tm.global(i32, false, 30)
+	fourth := tm.global(i32, true, 40)
+	tm.exportGlobal("fourth", fourth)
+
+	rewritten, names, err := exportMutableGlobals(tm.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the imported global belongs to the env module
+	want := []string{snapshotGlobalPrefix + "2", snapshotGlobalPrefix + "4"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("got names %v, want %v", names, want)
+	}
+
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	if _, err := rt.InstantiateWithConfig(ctx, env.bytes(), wazero.NewModuleConfig().WithName("env")); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := rt.Instantiate(ctx, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, idx := range []uint32{second, fourth} {
+		global, ok := mod.ExportedGlobal(names[i]).(api.MutableGlobal)
+		if !ok {
+			t.Fatalf("%s: not exported as mutable", names[i])
+		}
+		if got, want := global.Get(), uint64(idx)*10; got != want {
+			t.Fatalf("%s: got value %d, want %d", names[i], got, want)
+		}
+	}
+	if mod.ExportedGlobal("fourth") == nil {
+		t.Fatal("the existing export is gone")
+	}
+}
+
+func TestExportMutableGlobalsWithoutExports(t *testing.T) {
+	var tm testModule
+	tm.global(api.ValueTypeI64, true, 1)
+	rewritten, names, err := exportMutableGlobals(tm.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("got names %v", names)
+	}
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	defer rt.Close(ctx)
+	mod, err := rt.Instantiate(ctx, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mod.ExportedGlobal(names[0]).(api.MutableGlobal); !ok {
+		t.Fatalf("%s: not exported as mutable", names[0])
+	}
+}
+
+// counterModule builds a guest counting the requests it served, in a
+// global and in memory, and replying with both counts.
+func counterModule() []byte {
+	i32 := api.ValueTypeI32
+	var tm testModule
+	puts := tm.importFunc(hostModuleName, "oputs", []api.ValueType{i32, i32}, nil)
+	tm.memoryPages(1)
+	counter := tm.global(i32, true, 0)
+	add := []byte{0x6a} // i32.add
+	load := []byte{0x28, 0x02, 0x00}
+	run := tm.function(nil, nil, nil,
+		opGlobalGet(counter), opI32Const(1), add, opGlobalSet(counter),
+		opI32Const(0), opGlobalGet(counter), opI32Store(),
+		opI32Const(4), opI32Const(4), load, opI32Const(1), add, opI32Store(),
+		opI32Const(0), opI32Const(8), opCall(puts),
+	)
+	tm.exportFunc(runFnName, run)
+	return tm.bytes()
+}
+
+func TestEngineSnapshot(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		we := newTestEngine(t, counterModule(), moduleSettings{Snapshot: snapshot})
+		for i := uint32(0); i < 3; i++ {
+			var out bytes.Buffer
+			if err := we.Run(context.Background(), "test", strings.NewReader(""), testRequestEnv, &out); err != nil {
+				t.Fatal(err)
+			}
+			want := i + 1
+			if snapshot {
+				want = 1 // every request starts from the same state
+			}
+			global, memory := binary.LittleEndian.Uint32(out.Bytes()), binary.LittleEndian.Uint32(out.Bytes()[4:])
+			if global != want || memory != want {
+				t.Fatalf("snapshot %v, request %d: got counts %d and %d, want %d", snapshot, i, global, memory, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	storeDigestAlgo    = "sha256"
+	storeDigestPrefix  = storeDigestAlgo + ":"
+	storeIndexName     = "index.json"
+	storeLatestVersion = "latest"
+)
+
+var errStoreBadRef = errors.New("malformed module reference")
+
+// moduleStore is a content-addressed module store.
+// Blobs are kept by digest, and an index maps name@version to digests:
+//
+//	<root>/blobs/sha256/<hex>
+//	<root>/index.json
+//
+// References are "name" (same as "name@latest"), "name@version" or
+// "sha256:<hex>". Adding a module always moves its "latest" version,
+// so rolling back is just retagging "latest" to a previous digest.
+type moduleStore struct {
+	root string
+}
+
+type storeIndex struct {
+	// Modules maps name -> version -> digest
+	Modules map[string]map[string]string `json:"modules"`
+}
+
+func newModuleStore(root string) *moduleStore {
+	return &moduleStore{root: root}
+}
+
+func (ms *moduleStore) blobDir() string {
+	return filepath.Join(ms.root, "blobs", storeDigestAlgo)
+}
+
+func (ms *moduleStore) blobPath(digest string) string {
+	return filepath.Join(ms.blobDir(), strings.TrimPrefix(digest, storeDigestPrefix))
+}
+
+func (ms *moduleStore) indexPath() string {
+	return filepath.Join(ms.root, storeIndexName)
+}
+
+func (ms *moduleStore) readIndex() (*storeIndex, error) {
+	idx := storeIndex{
+		Modules: make(map[string]map[string]string),
+	}
+	data, err := os.ReadFile(ms.indexPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return &idx, nil // empty store
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("malformed store index: %w", err)
+	}
+	if idx.Modules == nil {
+		idx.Modules = make(map[string]map[string]string)
+	}
+	return &idx, nil
+}
+
+func (ms *moduleStore) writeIndex(idx *storeIndex) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ms.indexPath(), data)
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return storeDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// parseModuleRef splits a reference into name and version. Digest
+// references have neither, and are returned as-is in the digest.
+func parseModuleRef(ref string) (name, version, digest string, err error) {
+	if strings.HasPrefix(ref, storeDigestPrefix) {
+		hexDigest := strings.TrimPrefix(ref, storeDigestPrefix)
+		if _, err := hex.DecodeString(hexDigest); err != nil || len(hexDigest) != sha256.Size*2 {
+			return "", "", "", fmt.Errorf("%w: %q", errStoreBadRef, ref)
+		}
+		return "", "", ref, nil
+	}
+	name, version, _ = strings.Cut(ref, "@")
+	if version == "" {
+		version = storeLatestVersion
+	}
+	if name == "" || strings.ContainsAny(name, `/\:`) || strings.ContainsAny(version, `/\:@`) {
+		return "", "", "", fmt.Errorf("%w: %q", errStoreBadRef, ref)
+	}
+	return name, version, "", nil
+}
+
+// moduleRefName returns the module name part of a reference, if any.
+func moduleRefName(ref string) string {
+	name, _, _ := strings.Cut(ref, "@")
+	return name
+}
+
+// Add stores the module blob and points name@version, and name@latest, to it.
+func (ms *moduleStore) Add(ref string, data []byte) (string, error) {
+	name, version, _, err := parseModuleRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w: %q: need a name to add", errStoreBadRef, ref)
+	}
+
+	digest := digestOf(data)
+	blobPath := ms.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(blobPath); errors.Is(err, fs.ErrNotExist) {
+		if err := writeFileAtomic(blobPath, data); err != nil {
+			return "", err
+		}
+	}
+
+	idx, err := ms.readIndex()
+	if err != nil {
+		return "", err
+	}
+	setVersion(idx, name, version, digest)
+	setVersion(idx, name, storeLatestVersion, digest)
+	return digest, ms.writeIndex(idx)
+}
+
+// Tag points name@version to whatever the source reference resolves to.
+func (ms *moduleStore) Tag(srcRef, dstRef string) (string, error) {
+	name, version, _, err := parseModuleRef(dstRef)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w: %q: cannot tag a digest", errStoreBadRef, dstRef)
+	}
+
+	idx, err := ms.readIndex()
+	if err != nil {
+		return "", err
+	}
+	digest, err := ms.resolve(idx, srcRef)
+	if err != nil {
+		return "", err
+	}
+	setVersion(idx, name, version, digest)
+	return digest, ms.writeIndex(idx)
+}
+
+func setVersion(idx *storeIndex, name, version, digest string) {
+	versions, ok := idx.Modules[name]
+	if !ok {
+		versions = make(map[string]string)
+		idx.Modules[name] = versions
+	}
+	versions[version] = digest
+}
+
+// storeEntry is one name@version -> digest association.
+type storeEntry struct {
+	Name    string
+	Version string
+	Digest  string
+}
+
+func (ms *moduleStore) List() ([]storeEntry, error) {
+	idx, err := ms.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var entries []storeEntry
+	for name, versions := range idx.Modules {
+		for version, digest := range versions {
+			entries = append(entries, storeEntry{
+				Name:    name,
+				Version: version,
+				Digest:  digest,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Version < entries[j].Version
+	})
+	return entries, nil
+}
+
+// GC removes all the blobs no version refers to, and returns their digests.
+func (ms *moduleStore) GC() ([]string, error) {
+	idx, err := ms.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for _, versions := range idx.Modules {
+		for _, digest := range versions {
+			inUse[digest] = true
+		}
+	}
+
+	blobDir := ms.blobDir()
+	dirents, err := os.ReadDir(blobDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, dirent := range dirents {
+		digest := storeDigestPrefix + dirent.Name()
+		if dirent.IsDir() || inUse[digest] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobDir, dirent.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, digest)
+	}
+	return removed, nil
+}
+
+func (ms *moduleStore) Resolve(ref string) (string, error) {
+	idx, err := ms.readIndex()
+	if err != nil {
+		return "", err
+	}
+	return ms.resolve(idx, ref)
+}
+
+func (ms *moduleStore) resolve(idx *storeIndex, ref string) (string, error) {
+	name, version, digest, err := parseModuleRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if digest != "" {
+		if _, err := os.Stat(ms.blobPath(digest)); err != nil {
+			return "", err
+		}
+		return digest, nil
+	}
+	digest, ok := idx.Modules[name][version]
+	if !ok {
+		return "", fmt.Errorf("module %s@%s: %w", name, version, fs.ErrNotExist)
+	}
+	return digest, nil
+}
+
+// NamesOf returns the names of the modules with a version the
+// reference resolves to, sorted.
+func (ms *moduleStore) NamesOf(ref string) ([]string, error) {
+	idx, err := ms.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := ms.resolve(idx, ref)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, versions := range idx.Modules {
+		for _, versionDigest := range versions {
+			if versionDigest == digest {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Read returns the blob the reference resolves to, after checking it
+// still matches its digest.
+func (ms *moduleStore) Read(ref string) ([]byte, string, error) {
+	digest, err := ms.Resolve(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(ms.blobPath(digest))
+	if err != nil {
+		return nil, "", err
+	}
+	if got := digestOf(data); got != digest {
+		return nil, "", fmt.Errorf("corrupted blob: expected %s got %s", digest, got)
+	}
+	return data, digest, nil
+}
+
+// Open makes the store usable as a module source: the name is
+// a module reference followed by the usual ".wasm" extension.
+func (ms *moduleStore) Open(name string) (fs.File, error) {
+	ref, ok := strings.CutSuffix(name, ".wasm")
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	data, _, err := ms.Read(ref)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &memFile{
+		Reader: bytes.NewReader(data),
+		name:   name,
+		size:   int64(len(data)),
+	}, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseModuleRef(t *testing.T) {
+	digest := digestOf([]byte("module"))
+	tests := []struct {
+		ref         string
+		wantName    string
+		wantVersion string
+		wantDigest  string
+		wantErr     bool
+	}{
+		{ref: "echo", wantName: "echo", wantVersion: storeLatestVersion},
+		{ref: "echo@v1", wantName: "echo", wantVersion: "v1"},
+		{ref: digest, wantDigest: digest},
+		{ref: "", wantErr: true},
+		{ref: "@v1", wantErr: true},
+		{ref: "../echo", wantErr: true},
+		{ref: `..\echo`, wantErr: true},
+		{ref: "echo@../v1", wantErr: true},
+		{ref: "echo@v1@v2", wantErr: true},
+		{ref: "md5:abcd", wantErr: true},
+		{ref: storeDigestPrefix + "../../index.json", wantErr: true},
+		{ref: storeDigestPrefix + "abcd", wantErr: true},
+		{ref: strings.ToUpper(digest[:len(storeDigestPrefix)]) + digest[len(storeDigestPrefix):], wantErr: true},
+	}
+	for _, tt := range tests {
+		name, version, digest, err := parseModuleRef(tt.ref)
+		if tt.wantErr {
+			if !errors.Is(err, errStoreBadRef) {
+				t.Errorf("%q: got error %v, want %v", tt.ref, err, errStoreBadRef)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.ref, err)
+			continue
+		}
+		if name != tt.wantName || version != tt.wantVersion || digest != tt.wantDigest {
+			t.Errorf("%q: got %q %q %q, want %q %q %q", tt.ref, name, version, digest, tt.wantName, tt.wantVersion, tt.wantDigest)
+		}
+	}
+}
+
+func TestModuleStore(t *testing.T) {
+	ms := newModuleStore(t.TempDir())
+	v1, err := ms.Add("echo@v1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := ms.Add("echo@v2", []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ref, want := range map[string]string{"echo": v2, "echo@v1": v1, "echo@v2": v2, v1: v1} {
+		got, err := ms.Resolve(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%q: got %s, want %s", ref, got, want)
+		}
+	}
+
+	// rolling back
+	if _, err := ms.Tag("echo@v1", "echo"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(ms, "echo.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v1" {
+		t.Fatalf("got %q, want %q", data, "v1")
+	}
+
+	if _, err := ms.Tag("echo@v1", "echo@v2"); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := ms.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{v2}) {
+		t.Fatalf("got removed %v, want %v", removed, []string{v2})
+	}
+	if _, err := ms.Resolve(v2); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got error %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestModuleStoreRejectsBadRefs(t *testing.T) {
+	root := t.TempDir()
+	ms := newModuleStore(filepath.Join(root, "store"))
+	if err := os.WriteFile(filepath.Join(root, "outside.wasm"), []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"../outside", "echo/../../outside", storeDigestPrefix + "../../../outside.wasm"} {
+		if _, err := ms.Add(ref, []byte("x")); !errors.Is(err, errStoreBadRef) {
+			t.Errorf("add %q: got error %v, want %v", ref, err, errStoreBadRef)
+		}
+		if _, err := fs.ReadFile(ms, ref+".wasm"); !errors.Is(err, errStoreBadRef) {
+			t.Errorf("read %q: got error %v, want %v", ref, err, errStoreBadRef)
+		}
+	}
+	if _, err := ms.Add(digestOf([]byte("x")), []byte("x")); !errors.Is(err, errStoreBadRef) {
+		t.Errorf("add by digest: got error %v, want %v", err, errStoreBadRef)
+	}
+	if _, err := ms.Tag("echo", digestOf([]byte("x"))); !errors.Is(err, errStoreBadRef) {
+		t.Errorf("tag a digest: got error %v, want %v", err, errStoreBadRef)
+	}
+}
+
+func TestModuleStoreDetectsCorruption(t *testing.T) {
+	ms := newModuleStore(t.TempDir())
+	digest, err := ms.Add("echo", []byte("echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ms.blobPath(digest), []byte("tampered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ms.Read("echo"); err == nil {
+		t.Fatal("read succeeded, want an error")
+	}
+}
+
+func TestModuleStoreNamesOf(t *testing.T) {
+	ms := newModuleStore(t.TempDir())
+	digest, err := ms.Add("echo@v1", []byte("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Add("greet@v3", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Add("echo@v2", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := ms.NamesOf(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"echo", "greet"}; !slices.Equal(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+}
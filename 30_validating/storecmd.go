@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+const storeUsage = `usage: httpwasm store [-store DIR] COMMAND [ARGS...]
+
+commands:
+  add NAME[@VERSION] FILE.wasm  add a module, and make it the latest version
+  list                          list all the module versions
+  tag REF NAME@VERSION          point NAME@VERSION to the module REF resolves to
+  gc                            remove the modules no version refers to
+
+REF is NAME, NAME@VERSION or sha256:DIGEST.
+`
+
+func storeMain(args []string) int {
+	var storePath string
+	flags := flag.NewFlagSet("store", flag.ExitOnError)
+	flags.StringVar(&storePath, "store", "store", "module store directory")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), storeUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	ms := newModuleStore(storePath)
+	cmd, cmdArgs := flags.Arg(0), flags.Args()[1:]
+	err := runStoreCommand(ms, cmd, cmdArgs)
+	if errors.Is(err, errStoreUsage) {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "store %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+var errStoreUsage = errors.New("bad usage")
+
+func runStoreCommand(ms *moduleStore, cmd string, args []string) error {
+	switch cmd {
+	case "add":
+		if len(args) != 2 {
+			return errStoreUsage
+		}
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		digest, err := ms.Add(args[0], data)
+		if err != nil {
+			return err
+		}
+		fmt.Println(digest)
+
+	case "list":
+		if len(args) != 0 {
+			return errStoreUsage
+		}
+		entries, err := ms.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVERSION\tDIGEST")
+		for _, entry := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", entry.Name, entry.Version, entry.Digest)
+		}
+		return tw.Flush()
+
+	case "tag":
+		if len(args) != 2 {
+			return errStoreUsage
+		}
+		digest, err := ms.Tag(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(digest)
+
+	case "gc":
+		if len(args) != 0 {
+			return errStoreUsage
+		}
+		removed, err := ms.GC()
+		for _, digest := range removed {
+			fmt.Println(digest)
+		}
+		return err
+
+	default:
+		return errStoreUsage
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	nameSectionName       = "name"
+	debugSectionPrefix    = ".debug_"
+	nameSubsectionModule  = 0
+	nameSubsectionFuncs   = 1
+	wazeroTraceHeader     = "\nwasm stack trace:\n"
+	wazeroInlinedSuffix   = " (inlined)"
+	unknownFunctionPrefix = "$"
+)
+
+// stackFrame is a symbolicated frame of a guest stack trace.
+type stackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Inlined  bool   `json:"inlined,omitempty"`
+}
+
+func (sf stackFrame) String() string {
+	if sf.File == "" {
+		return sf.Function
+	}
+	loc := sf.File + ":" + strconv.Itoa(sf.Line)
+	if sf.Column > 0 {
+		loc += ":" + strconv.Itoa(sf.Column)
+	}
+	if sf.Inlined {
+		loc += wazeroInlinedSuffix
+	}
+	return sf.Function + " at " + loc
+}
+
+type sourceLocation struct {
+	file string
+	line int
+}
+
+// moduleSymbols holds the debug information of a guest module: the
+// function names from the name section, and where each function is
+// declared, from the DWARF sections.
+//
+// wazero resolves the exact source line of each frame from the DWARF line
+// table when it can; when it can't (e.g. running the interpreter, or the
+// code was rewritten by fuel instrumentation, which drops the DWARF
+// sections), we fall back to where the function is declared, read from
+// the original binary, which is still much better than nothing.
+type moduleSymbols struct {
+	// wazero prefixes this to the guest function names
+	modName   string
+	funcNames map[uint32]string
+	funcIndex map[string]uint32
+	decls     map[string]sourceLocation
+	// where the body of each defined function starts in the code section;
+	// nil if the code run is not the original one
+	importedFuncs uint32
+	bodyOffsets   []uint32
+}
+
+// readModuleSymbols never fails: modules without or with broken debug
+// information just get less informative stack traces.
+func readModuleSymbols(wasmObj []byte) *moduleSymbols {
+	ms := moduleSymbols{
+		funcNames: make(map[uint32]string),
+		funcIndex: make(map[string]uint32),
+		decls:     make(map[string]sourceLocation),
+	}
+	sections, err := parseWasmSections(wasmObj)
+	if err != nil {
+		log.Printf("symbols: cannot parse module: %v", err)
+		return &ms
+	}
+	debugSections := make(map[string][]byte)
+	for _, sec := range sections {
+		switch sec.id {
+		case wasmSectionImport:
+			imports, err := countImports(sec.payload)
+			if err != nil {
+				log.Printf("symbols: ignoring malformed import section: %v", err)
+			}
+			ms.importedFuncs = uint32(imports.funcs)
+			continue
+		case wasmSectionCode:
+			if err := ms.readCodeSection(sec.payload); err != nil {
+				log.Printf("symbols: ignoring malformed code section: %v", err)
+			}
+			continue
+		case wasmSectionCustom:
+		default:
+			continue
+		}
+		rd := wasmReader{data: sec.payload}
+		name, err := rd.bytes()
+		if err != nil {
+			continue
+		}
+		content := sec.payload[rd.pos:]
+		switch {
+		case string(name) == nameSectionName:
+			if err := ms.readNameSection(content); err != nil {
+				log.Printf("symbols: ignoring malformed name section: %v", err)
+			}
+		case strings.HasPrefix(string(name), debugSectionPrefix):
+			debugSections[string(name)] = content
+		}
+	}
+	for idx, name := range ms.funcNames {
+		ms.funcIndex[name] = idx
+	}
+	if len(debugSections) > 0 {
+		if err := ms.readDWARF(debugSections); err != nil {
+			log.Printf("symbols: ignoring malformed DWARF data: %v", err)
+		}
+	}
+	log.Printf("symbols: %d function names, %d function declarations", len(ms.funcNames), len(ms.decls))
+	return &ms
+}
+
+func (ms *moduleSymbols) readNameSection(content []byte) error {
+	rd := wasmReader{data: content}
+	for !rd.done() {
+		id, err := rd.byte()
+		if err != nil {
+			return err
+		}
+		sub, err := rd.bytes()
+		if err != nil {
+			return err
+		}
+		srd := wasmReader{data: sub}
+		if id == nameSubsectionModule {
+			name, err := srd.bytes()
+			if err != nil {
+				return err
+			}
+			ms.modName = string(name)
+			continue
+		}
+		if id != nameSubsectionFuncs {
+			continue
+		}
+		count, err := srd.u32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < count; i++ {
+			idx, err := srd.u32()
+			if err != nil {
+				return err
+			}
+			name, err := srd.bytes()
+			if err != nil {
+				return err
+			}
+			ms.funcNames[idx] = string(name)
+		}
+	}
+	return nil
+}
+
+func (ms *moduleSymbols) readCodeSection(payload []byte) error {
+	rd := wasmReader{data: payload}
+	count, err := rd.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		size, err := rd.u32()
+		if err != nil {
+			return err
+		}
+		ms.bodyOffsets = append(ms.bodyOffsets, uint32(rd.pos))
+		if err := rd.skip(int(size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *moduleSymbols) readDWARF(sections map[string][]byte) error {
+	data, err := dwarf.New(
+		sections[".debug_abbrev"],
+		sections[".debug_aranges"],
+		sections[".debug_frame"],
+		sections[".debug_info"],
+		sections[".debug_line"],
+		sections[".debug_pubnames"],
+		sections[".debug_ranges"],
+		sections[".debug_str"],
+	)
+	if err != nil {
+		return err
+	}
+	// DWARF 5, emitted by recent LLVM-based toolchains
+	for _, name := range []string{".debug_addr", ".debug_line_str", ".debug_loclists", ".debug_rnglists", ".debug_str_offsets"} {
+		if content, ok := sections[name]; ok {
+			if err := data.AddSection(name, content); err != nil {
+				return err
+			}
+		}
+	}
+
+	rd := data.Reader()
+	var files []*dwarf.LineFile
+	for {
+		entry, err := rd.Next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return nil
+		}
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			files = nil
+			if lr, err := data.LineReader(entry); err == nil && lr != nil {
+				files = lr.Files()
+			}
+		case dwarf.TagSubprogram:
+			ms.addDecl(entry, files)
+		}
+	}
+}
+
+func (ms *moduleSymbols) addDecl(entry *dwarf.Entry, files []*dwarf.LineFile) {
+	fileIdx, ok := entry.Val(dwarf.AttrDeclFile).(int64)
+	if !ok || fileIdx < 0 || int(fileIdx) >= len(files) || files[fileIdx] == nil {
+		return
+	}
+	line, _ := entry.Val(dwarf.AttrDeclLine).(int64)
+	loc := sourceLocation{
+		file: files[fileIdx].Name,
+		line: int(line),
+	}
+	// the name section holds the linkage names, when they differ
+	for _, attr := range []dwarf.Attr{dwarf.AttrLinkageName, dwarf.AttrName} {
+		if name, ok := entry.Val(attr).(string); ok && name != "" {
+			if _, seen := ms.decls[name]; !seen {
+				ms.decls[name] = loc
+			}
+		}
+	}
+}
+
+// traceEntry is a frame of a wazero stack trace: the function, as in
+// "module.function(i32,i32) i64", and the source locations wazero
+// resolved, if any, as in "0x1234: /path/to/file.go:12:3 (inlined)".
+type traceEntry struct {
+	desc    string
+	sources []string
+}
+
+// parseWazeroTrace extracts the stack trace wazero attached to err, if any.
+func parseWazeroTrace(err error) []traceEntry {
+	_, trace, ok := strings.Cut(err.Error(), wazeroTraceHeader)
+	if !ok {
+		return nil
+	}
+	// a Go runtime trace may follow, after an empty line
+	trace, _, _ = strings.Cut(trace, "\n\n")
+
+	var entries []traceEntry
+	for _, line := range strings.Split(trace, "\n") {
+		switch {
+		case strings.HasPrefix(line, "\t\t"):
+			if len(entries) > 0 {
+				last := &entries[len(entries)-1]
+				last.sources = append(last.sources, strings.TrimPrefix(line, "\t\t"))
+			}
+		case strings.HasPrefix(line, "\t"):
+			entries = append(entries, traceEntry{desc: strings.TrimPrefix(line, "\t")})
+		}
+	}
+	return entries
+}
+
+// Symbolicate extracts the stack trace wazero attached to err, if any,
+// and resolves its frames.
+func (ms *moduleSymbols) Symbolicate(err error) []stackFrame {
+	var frames []stackFrame
+	for _, entry := range parseWazeroTrace(err) {
+		frames = append(frames, ms.resolveFrame(entry.desc))
+		for _, src := range entry.sources {
+			frames = appendSourceFrame(frames, src)
+		}
+	}
+	return frames
+}
+
+// guestFunction returns the name of the guest function described by
+// a wazero frame, or false if the frame belongs to another module.
+func (ms *moduleSymbols) guestFunction(desc string) (string, bool) {
+	name, _, _ := strings.Cut(desc, "(")
+	fn, ok := strings.CutPrefix(name, ms.modName+".")
+	if !ok {
+		return name, false
+	}
+	if idx, ok := strings.CutPrefix(fn, unknownFunctionPrefix); ok {
+		if n, err := strconv.ParseUint(idx, 10, 32); err == nil {
+			if symName, ok := ms.funcNames[uint32(n)]; ok {
+				fn = symName
+			}
+		}
+	}
+	return fn, true
+}
+
+func (ms *moduleSymbols) resolveFrame(desc string) stackFrame {
+	fn, ok := ms.guestFunction(desc)
+	if !ok {
+		// host or wasi
+		return stackFrame{Function: fn}
+	}
+	sf := stackFrame{Function: fn}
+	if loc, ok := ms.decls[fn]; ok {
+		sf.File = loc.file
+		sf.Line = loc.line
+	}
+	return sf
+}
+
+// appendSourceFrame records the exact source location of the last frame.
+// When there is more than one location, the frame was inlined in the
+// following ones: each gets its own frame.
+func appendSourceFrame(frames []stackFrame, src string) []stackFrame {
+	// the offset is only on the first line, the inlined frames are
+	// indented instead
+	loc := strings.TrimLeft(src, " ")
+	if strings.HasPrefix(loc, "0x") {
+		var ok bool
+		if _, loc, ok = strings.Cut(loc, ": "); !ok {
+			return frames
+		}
+	}
+	loc, inlined := strings.CutSuffix(loc, wazeroInlinedSuffix)
+
+	// file names may contain colons, the numbers are always at the end
+	parts := strings.Split(loc, ":")
+	var nums []int
+	for len(parts) > 1 && len(nums) < 2 {
+		n, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		parts = parts[:len(parts)-1]
+	}
+
+	last := &frames[len(frames)-1]
+	if last.File != "" && last.Inlined {
+		frames = append(frames, stackFrame{Function: last.Function})
+		last = &frames[len(frames)-1]
+	}
+	last.File = strings.Join(parts, ":")
+	last.Line, last.Column = 0, 0
+	if len(nums) > 0 {
+		last.Line = nums[0]
+	}
+	if len(nums) > 1 {
+		last.Column = nums[1]
+	}
+	last.Inlined = inlined
+	return frames
+}
+
+func formatStackTrace(frames []stackFrame) string {
+	var sb strings.Builder
+	for _, sf := range frames {
+		fmt.Fprintf(&sb, "\n\t%s", sf)
+	}
+	return sb.String()
+}
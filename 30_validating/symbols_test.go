@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// nameSection builds the payload of a name section with the module name,
+// and the names of the functions in index order.
+func nameSection(modName string, funcNames ...string) []byte {
+	subsection := func(out []byte, id byte, content []byte) []byte {
+		out = binary.AppendUvarint(append(out, id), uint64(len(content)))
+		return append(out, content...)
+	}
+	out := subsection(nil, nameSubsectionModule, testName(nil, modName))
+	funcs := binary.AppendUvarint(nil, uint64(len(funcNames)))
+	for idx, name := range funcNames {
+		funcs = testName(binary.AppendUvarint(funcs, uint64(idx)), name)
+	}
+	return subsection(out, nameSubsectionFuncs, funcs)
+}
+
+// nestedTrapModule builds a guest whose entrypoint traps in a nested call,
+// with the given name section, if any.
+func nestedTrapModule(names []byte) []byte {
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	var tm testModule
+	const unreachable, drop = 0x00, 0x1a
+	inner := tm.function([]api.ValueType{i32}, []api.ValueType{i64}, nil, []byte{unreachable})
+	tm.exportFunc(runFnName, tm.function(nil, nil, nil, opI32Const(0), opCall(inner), []byte{drop}))
+	if names != nil {
+		tm.custom(nameSectionName, names)
+	}
+	return tm.bytes()
+}
+
+// wazeroTrap runs the entrypoint of the guest, and returns the error.
+func wazeroTrap(t *testing.T, wasmObj []byte) error {
+	t.Helper()
+	ctx := context.Background()
+	rt := wazero.NewRuntime(ctx)
+	t.Cleanup(func() { rt.Close(ctx) })
+	mod, err := rt.InstantiateWithConfig(ctx, wasmObj, wazero.NewModuleConfig().WithName("instance"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mod.ExportedFunction(runFnName).Call(ctx)
+	if err == nil {
+		t.Fatal("the guest didn't trap")
+	}
+	return err
+}
+
+// parseWazeroTrace relies on the format of the wazero errors: this pins
+// it, so a wazero upgrade changing it fails here first.
+func TestWazeroTraceFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []byte
+		want  string
+	}{
+		{
+			name:  "name section",
+			names: nameSection("guest", "inner", "run"),
+			want:  "wasm error: unreachable\nwasm stack trace:\n\tguest.inner(i32) i64\n\tguest.run()",
+		},
+		{
+			name: "no name section",
+			want: "wasm error: unreachable\nwasm stack trace:\n\t.$0(i32) i64\n\t.$1()",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := wazeroTrap(t, nestedTrapModule(tt.names)); err.Error() != tt.want {
+				t.Fatalf("got error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWazeroTrace(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+		want []traceEntry
+	}{
+		{name: "no trace", err: "module closed with exit_code(1)"},
+		{
+			name: "frames",
+			err:  "wasm error: unreachable\nwasm stack trace:\n\tguest.inner(i32) i64\n\tguest.run()",
+			want: []traceEntry{{desc: "guest.inner(i32) i64"}, {desc: "guest.run()"}},
+		},
+		{
+			name: "source locations",
+			err: "wasm error: unreachable\nwasm stack trace:\n\tguest.inner(i32) i64\n" +
+				"\t\t0x1f: /src/util.go:12:3 (inlined)\n" +
+				"\t\t      /src/main.go:20:5\n" +
+				"\tguest.run()\n" +
+				"\t\t0x40: /src/main.go:30",
+			want: []traceEntry{
+				{desc: "guest.inner(i32) i64", sources: []string{"0x1f: /src/util.go:12:3 (inlined)", "      /src/main.go:20:5"}},
+				{desc: "guest.run()", sources: []string{"0x40: /src/main.go:30"}},
+			},
+		},
+		{
+			name: "host function panic",
+			err: "oputs: output too large (recovered by wazero)\nwasm stack trace:\n\thttpwasm.oputs(i32,i32)\n\tguest.run()\n\n" +
+				"Go runtime stack trace:\ngoroutine 1 [running]:\n\tmain.oputs()",
+			want: []traceEntry{{desc: "httpwasm.oputs(i32,i32)"}, {desc: "guest.run()"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseWazeroTrace(errors.New(tt.err)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSymbolicate(t *testing.T) {
+	// the code run may have lost its name section, e.g. to the fuel
+	// instrumentation: the names come from the original binary
+	ms := readModuleSymbols(nestedTrapModule(nameSection("guest", "inner", "run")))
+	tests := []struct {
+		name string
+		err  string
+		want []stackFrame
+	}{
+		{name: "no trace", err: "module closed with exit_code(1)"},
+		{
+			name: "names",
+			err:  "wasm error: unreachable\nwasm stack trace:\n\tguest.inner(i32) i64\n\tguest.$1()",
+			want: []stackFrame{{Function: "inner"}, {Function: "run"}},
+		},
+		{
+			name: "host frames",
+			err:  "oputs: output too large (recovered by wazero)\nwasm stack trace:\n\thttpwasm.oputs(i32,i32)\n\tguest.run()",
+			want: []stackFrame{{Function: "httpwasm.oputs"}, {Function: "run"}},
+		},
+		{
+			name: "unknown index",
+			err:  "wasm error: unreachable\nwasm stack trace:\n\tguest.$7()",
+			want: []stackFrame{{Function: "$7"}},
+		},
+		{
+			name: "source locations",
+			err: "wasm error: unreachable\nwasm stack trace:\n\tguest.inner(i32) i64\n" +
+				"\t\t0x1f: /src/util.go:12:3 (inlined)\n" +
+				"\t\t      C:/src/main.go:20:5\n" +
+				"\tguest.run()\n" +
+				"\t\t0x40: /src/main.go:30",
+			want: []stackFrame{
+				{Function: "inner", File: "/src/util.go", Line: 12, Column: 3, Inlined: true},
+				{Function: "inner", File: "C:/src/main.go", Line: 20, Column: 5},
+				{Function: "run", File: "/src/main.go", Line: 30},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ms.Symbolicate(errors.New(tt.err)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// the frames of a real trap resolve, end to end
+func TestSymbolicateTrap(t *testing.T) {
+	wasmObj := nestedTrapModule(nameSection("guest", "inner", "run"))
+	frames := readModuleSymbols(wasmObj).Symbolicate(wazeroTrap(t, wasmObj))
+	if want := []stackFrame{{Function: "inner"}, {Function: "run"}}; !reflect.DeepEqual(frames, want) {
+		t.Fatalf("got %+v, want %+v", frames, want)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// testModule assembles small wasm binaries for the tests: *.wasm files
+// are not tracked, and the guests can't be built while testing anyway.
+// The imports must be added before the functions and the globals, since
+// they come first in the index spaces.
+type testModule struct {
+	types   [][]byte
+	imports [][]byte
+	funcs   []uint32
+	bodies  [][]byte
+	memory  []byte
+	globals [][]byte
+	exports [][]byte
+	data    [][]byte
+	// the payloads of the custom sections, name included
+	customs [][]byte
+
+	importedFuncs   uint32
+	importedGlobals uint32
+}
+
+func (tm *testModule) funcType(params, results []api.ValueType) uint32 {
+	typ := []byte{0x60}
+	typ = append(binary.AppendUvarint(typ, uint64(len(params))), params...)
+	typ = append(binary.AppendUvarint(typ, uint64(len(results))), results...)
+	if idx := slices.IndexFunc(tm.types, func(t []byte) bool { return bytes.Equal(t, typ) }); idx >= 0 {
+		return uint32(idx)
+	}
+	tm.types = append(tm.types, typ)
+	return uint32(len(tm.types) - 1)
+}
+
+// importFunc returns the index of the imported function.
+func (tm *testModule) importFunc(module, name string, params, results []api.ValueType) uint32 {
+	if len(tm.funcs) > 0 {
+		panic("testModule: imports must come before the functions")
+	}
+	imp := testName(testName(nil, module), name)
+	imp = binary.AppendUvarint(append(imp, 0x00), uint64(tm.funcType(params, results)))
+	tm.imports = append(tm.imports, imp)
+	tm.importedFuncs++
+	return tm.importedFuncs - 1
+}
+
+// importGlobal returns the index of the imported global. Like the
+// functions, they must be imported before the others are added.
+func (tm *testModule) importGlobal(module, name string, typ api.ValueType, mutable bool) uint32 {
+	if len(tm.globals) > 0 {
+		panic("testModule: imports must come before the globals")
+	}
+	imp := testName(testName(nil, module), name)
+	imp = append(imp, 0x03, typ, 0x00)
+	if mutable {
+		imp[len(imp)-1] = 0x01
+	}
+	tm.imports = append(tm.imports, imp)
+	tm.importedGlobals++
+	return tm.importedGlobals - 1
+}
+
+// function adds a function with a local of each of the locals types,
+// after the parameters, and returns its index. The body misses the
+// final "end".
+func (tm *testModule) function(params, results, locals []api.ValueType, body ...[]byte) uint32 {
+	tm.funcs = append(tm.funcs, tm.funcType(params, results))
+	code := binary.AppendUvarint(nil, uint64(len(locals)))
+	for _, typ := range locals {
+		code = append(code, 1, typ)
+	}
+	code = append(append(code, bytes.Join(body, nil)...), 0x0b)
+	tm.bodies = append(tm.bodies, code)
+	return tm.importedFuncs + uint32(len(tm.funcs)) - 1
+}
+
+// memoryPages adds the memory, exported as "memory".
+func (tm *testModule) memoryPages(minPages uint32) {
+	tm.memory = binary.AppendUvarint([]byte{0x00}, uint64(minPages))
+	tm.export("memory", 0x02, 0)
+}
+
+// global adds an integer global, and returns its index.
+func (tm *testModule) global(typ api.ValueType, mutable bool, init int64) uint32 {
+	glob := []byte{typ, 0x00}
+	if mutable {
+		glob[1] = 0x01
+	}
+	op := byte(0x41) // i32.const
+	if typ == api.ValueTypeI64 {
+		op = 0x42 // i64.const
+	}
+	glob = append(testSleb(append(glob, op), init), 0x0b)
+	tm.globals = append(tm.globals, glob)
+	return tm.importedGlobals + uint32(len(tm.globals)) - 1
+}
+
+func (tm *testModule) exportFunc(name string, idx uint32) {
+	tm.export(name, 0x00, idx)
+}
+
+func (tm *testModule) exportGlobal(name string, idx uint32) {
+	tm.export(name, 0x03, idx)
+}
+
+func (tm *testModule) export(name string, kind byte, idx uint32) {
+	tm.exports = append(tm.exports, binary.AppendUvarint(append(testName(nil, name), kind), uint64(idx)))
+}
+
+// dataAt adds an active data segment of the memory.
+func (tm *testModule) dataAt(offset int32, content []byte) {
+	seg := append(testSleb([]byte{0x00, 0x41}, int64(offset)), 0x0b)
+	tm.data = append(tm.data, append(binary.AppendUvarint(seg, uint64(len(content))), content...))
+}
+
+func (tm *testModule) custom(name string, content []byte) {
+	tm.customs = append(tm.customs, append(testName(nil, name), content...))
+}
+
+func (tm *testModule) bytes() []byte {
+	out := []byte("\x00asm\x01\x00\x00\x00")
+	section := func(id byte, payload []byte) {
+		out = append(binary.AppendUvarint(append(out, id), uint64(len(payload))), payload...)
+	}
+	vec := func(id byte, entries [][]byte) {
+		if len(entries) > 0 {
+			section(id, testVec(entries...))
+		}
+	}
+	vec(1, tm.types)
+	vec(2, tm.imports)
+	funcs := make([][]byte, len(tm.funcs))
+	for idx, typ := range tm.funcs {
+		funcs[idx] = binary.AppendUvarint(nil, uint64(typ))
+	}
+	vec(3, funcs)
+	if tm.memory != nil {
+		vec(5, [][]byte{tm.memory})
+	}
+	vec(6, tm.globals)
+	vec(7, tm.exports)
+	bodies := make([][]byte, len(tm.bodies))
+	for idx, body := range tm.bodies {
+		bodies[idx] = append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+	}
+	vec(10, bodies)
+	vec(11, tm.data)
+	for _, payload := range tm.customs {
+		section(0, payload)
+	}
+	return out
+}
+
+func testVec(entries ...[]byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(entries))), bytes.Join(entries, nil)...)
+}
+
+func testName(out []byte, name string) []byte {
+	return append(binary.AppendUvarint(out, uint64(len(name))), name...)
+}
+
+func testSleb(out []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// the instructions the tests use
+
+func opI32Const(v int32) []byte { return testSleb([]byte{0x41}, int64(v)) }
+
+func opI64Const(v int64) []byte { return testSleb([]byte{0x42}, v) }
+
+func opCall(idx uint32) []byte { return binary.AppendUvarint([]byte{0x10}, uint64(idx)) }
+
+func opLocalGet(idx uint32) []byte { return binary.AppendUvarint([]byte{0x20}, uint64(idx)) }
+
+func opLocalSet(idx uint32) []byte { return binary.AppendUvarint([]byte{0x21}, uint64(idx)) }
+
+func opGlobalGet(idx uint32) []byte { return binary.AppendUvarint([]byte{0x23}, uint64(idx)) }
+
+func opGlobalSet(idx uint32) []byte { return binary.AppendUvarint([]byte{0x24}, uint64(idx)) }
+
+// opI32Store stores with no offset and the natural alignment.
+func opI32Store() []byte { return []byte{0x36, 0x02, 0x00} }
+
+// opLoopForever is a loop branching back to its header.
+func opLoopForever() []byte { return []byte{0x03, 0x40, 0x0c, 0x00, 0x0b} }